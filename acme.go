@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ACMEConfig describes how certificates are obtained from an ACME CA like Let's Encrypt
+type ACMEConfig struct {
+	// Domains are the host names certificates are requested for, requests for other names are refused
+	Domains []string `yaml:"domains,omitempty" flag:"acmeDomains"`
+	// DirectoryURL defaults to the Let's Encrypt production directory
+	DirectoryURL string `yaml:"directory,omitempty" flag:"acmeDirectory"`
+	Email        string `yaml:"email,omitempty" flag:"acmeEmail"`
+	// CacheDir stores the account key and the certificates so they survive restarts
+	CacheDir string `yaml:"cache_dir,omitempty" flag:"acmeCacheDir"`
+	// CAFile is a PEM bundle trusted for connections to the directory, e.g. the root of a local Pebble
+	CAFile string `yaml:"ca,omitempty" flag:"acmeCA"`
+	// HTTPAddress answers HTTP-01 challenges
+	HTTPAddress string `yaml:"http_address,omitempty" flag:"acmeHTTPAddress"`
+}
+
+// newCertManager creates a manager which obtains and renews certificates for the configured domains.
+// TLS-ALPN-01 challenges are answered by the TLS listener, HTTP-01 challenges by the handler returned
+// by the manager's HTTPHandler.
+func newCertManager(config ACMEConfig) (*autocert.Manager, error) {
+	domains := make([]string, 0, len(config.Domains))
+	for _, domain := range config.Domains {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("ACME needs at least one domain")
+	}
+	if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	client := &acme.Client{DirectoryURL: config.DirectoryURL, UserAgent: "kranen/" + version}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if config.CAFile != "" {
+		content, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("%s contains no PEM certificates", config.CAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.CacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Client:     client,
+		Email:      config.Email,
+	}
+	return manager, nil
+}
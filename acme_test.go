@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertManager(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-acme-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, "acme")
+
+	_, err = newCertManager(ACMEConfig{Domains: []string{" "}, CacheDir: cacheDir})
+	assert.NotNil(err)
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte("no certificate"), 0600)
+	_, err = newCertManager(ACMEConfig{Domains: []string{"kranen.example.com"}, CacheDir: cacheDir, CAFile: filepath.Join(dir, "ca.pem")})
+	assert.NotNil(err)
+
+	manager, err := newCertManager(ACMEConfig{
+		Domains:      []string{"kranen.example.com", " hooks.example.com"},
+		DirectoryURL: "https://localhost:14000/dir",
+		Email:        "ops@example.com",
+		CacheDir:     cacheDir,
+	})
+	assert.Nil(err)
+	assert.Equal("https://localhost:14000/dir", manager.Client.DirectoryURL)
+	assert.Equal("ops@example.com", manager.Email)
+	info, err := os.Stat(cacheDir)
+	assert.Nil(err)
+	assert.True(info.IsDir())
+
+	// Certificates are only requested for the configured domains
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	assert.NotNil(err)
+	assert.Contains(manager.TLSConfig().NextProtos, "acme-tls/1")
+
+	handler := manager.HTTPHandler(nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://other.example.com/.well-known/acme-challenge/token", nil))
+	assert.Equal(http.StatusForbidden, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://hooks.example.com/.well-known/acme-challenge/token", nil))
+	assert.Equal(http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://hooks.example.com/healthz", nil))
+	assert.Equal(http.StatusFound, w.Code)
+	assert.Equal("https://hooks.example.com/healthz", w.Header().Get("Location"))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// adminUsers maps user names to passwords of users allowed to use the admin API
+type adminUsers map[string]string
+
+type adminHandle func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string)
+
+// TriggerRequest is the body of a manual trigger request, all fields are optional
+type TriggerRequest struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
+// loadAdminUsers reads a file of user:password lines, empty lines and lines starting with # are ignored
+func loadAdminUsers(path string) (adminUsers, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(adminUsers)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, line)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, scanner.Err()
+}
+
+func (u adminUsers) authenticate(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, found := u[user]
+	if !found {
+		// Compare anyway so unknown users can't be detected by timing
+		expected = "\x00"
+	}
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	return user, found && match
+}
+
+func requireAdmin(users adminUsers, handle adminHandle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, ok := users.authenticate(r)
+		if !ok {
+			if r.Method == http.MethodPost {
+				entry := newAdminAuditEntry(r, ps, user)
+				entry.reject(rejectUnauthorized)
+				audit.Record(entry)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="kranen"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handle(w, r, ps, user)
+	}
+}
+
+func registerAdminRoutes(router *httprouter.Router, users adminUsers) {
+	router.GET("/admin/runs", requireAdmin(users, listRuns))
+	router.GET("/admin/runs/:id", requireAdmin(users, getRun))
+	router.GET("/admin/runs/:id/log", requireAdmin(users, getRunLog))
+	router.GET("/runs/:id/stream", requireAdmin(users, streamRun))
+	// Hook IDs default to <name>:<tag> and Docker Hub names contain a slash, so the hook is matched
+	// by a catch-all route and the action is taken from the end of the path
+	router.POST("/admin/hooks/*hook", requireAdmin(users, hookAction))
+	registerDashboardRoutes(router, users)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Warn("Can't write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func listRuns(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	writeJSON(w, http.StatusOK, history.List())
+}
+
+func getRun(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	run, found := history.Get(ps.ByName("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Run %s does not exist", ps.ByName("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// hookActions are the handlers of /admin/hooks/<hook>/<action> by action
+var hookActions = map[string]func(http.ResponseWriter, *http.Request, httprouter.Params, string){
+	"trigger":  triggerHook,
+	"rollback": rollbackHook,
+}
+
+func hookAction(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	path := strings.TrimPrefix(ps.ByName("hook"), "/")
+	separator := strings.LastIndex(path, "/")
+	if separator <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	handle, found := hookActions[path[separator+1:]]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	handle(w, r, httprouter.Params{{Key: "hook", Value: path[:separator]}}, user)
+}
+
+// manualPayload synthesizes a Docker Hub payload for a manually triggered run of the hook
+func manualPayload(config RepoConfig, request TriggerRequest, user string) Payload {
+	tag := request.Tag
+	if tag == "" {
+		tag = config.Tag
+	}
+	namespace, name := "", config.Name
+	if parts := strings.SplitN(config.Name, "/", 2); len(parts) == 2 {
+		namespace, name = parts[0], parts[1]
+	}
+	return Payload{
+		PushData: &PushData{
+			Tag:      tag,
+			Digest:   request.Digest,
+			Pusher:   user,
+			PushedAt: float64(time.Now().Unix()),
+		},
+		Repo: &Repository{
+			Name:      name,
+			Namespace: namespace,
+			RepoName:  config.Name,
+		},
+	}
+}
+
+func newAdminAuditEntry(r *http.Request, ps httprouter.Params, user string) AuditEntry {
+	entry := newAuditEntry(r, sourceAdmin)
+	entry.User = user
+	entry.Hook = ps.ByName("hook")
+	return entry
+}
+
+func triggerHook(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	entry := newAdminAuditEntry(r, ps, user)
+	defer func() { audit.Record(entry) }()
+	if rejectWhileDraining(w) {
+		entry.reject(rejectShuttingDown)
+		return
+	}
+	config, found := findHook(ps.ByName("hook"))
+	if !found {
+		entry.reject(rejectUnknownHook)
+		writeError(w, http.StatusNotFound, fmt.Errorf("Hook %s does not exist", ps.ByName("hook")))
+		return
+	}
+	entry.Repo = config.Name
+	var request TriggerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		entry.reject(rejectBadRequest)
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Can't parse trigger request: %+v", err))
+		return
+	}
+	payload := manualPayload(config, request, user)
+	rawPayload, err := json.Marshal(payload)
+	if err != nil {
+		entry.reject(rejectQueueError)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	job := newJob(r.Context(), config, payload, rawPayload, TriggerManual)
+	job.logger().Info("Hook triggered manually", "user", user, "tag", job.Run.Tag)
+	acceptManualJob(w, job, user, &entry)
+}
+
+func rollbackHook(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	entry := newAdminAuditEntry(r, ps, user)
+	defer func() { audit.Record(entry) }()
+	if rejectWhileDraining(w) {
+		entry.reject(rejectShuttingDown)
+		return
+	}
+	job, err := rollbackJob(r.Context(), ps.ByName("hook"))
+	if err != nil {
+		entry.reject(rejectNoRollback)
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	job.logger().Info("Hook rolled back manually", "user", user, "tag", job.Run.Tag)
+	acceptManualJob(w, job, user, &entry)
+}
+
+func acceptManualJob(w http.ResponseWriter, job Job, user string, entry *AuditEntry) {
+	var response Run
+	history.update(job.Run, func(run *Run) {
+		run.User = user
+		response = run.copy()
+	})
+	if err := executeScript(job); err != nil {
+		job.logger().Error("Can't queue run", "error", err)
+		entry.reject(rejectQueueError)
+		entry.RunID = job.Run.ID
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Can't queue run: %+v", err))
+		return
+	}
+	entry.accept(job.Run)
+	writeJSON(w, http.StatusAccepted, response)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func adminTestServer(t *testing.T) (*httptest.Server, chan Job) {
+	configs = []RepoConfig{
+		{ID: "test", Name: "connctd/test", ApiKey: "foobaz", Tag: "latest", Script: "/deploy.sh"},
+		{Name: "connctd/other", ApiKey: "foobaz", Tag: "stable", Script: "/deploy.sh"},
+	}
+	jobs := make(chan Job, 1)
+	executionChan = jobs
+	router := httprouter.New()
+	registerAdminRoutes(router, adminUsers{"alice": "secret"})
+	return httptest.NewServer(router), jobs
+}
+
+func TestLoadAdminUsers(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-admin-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "users")
+	ioutil.WriteFile(path, []byte("# admins\nalice:secret\n\nbob:pass:word\n"), 0600)
+	users, err := loadAdminUsers(path)
+	assert.Nil(err)
+	assert.Equal(adminUsers{"alice": "secret", "bob": "pass:word"}, users)
+
+	ioutil.WriteFile(path, []byte("alice\n"), 0600)
+	_, err = loadAdminUsers(path)
+	assert.NotNil(err)
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	server, _ := adminTestServer(t)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/runs")
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest("GET", server.URL+"/admin/runs", nil)
+	req.SetBasicAuth("alice", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	req.SetBasicAuth("alice", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestManualTrigger(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	server, jobs := adminTestServer(t)
+	defer server.Close()
+
+	body, _ := json.Marshal(TriggerRequest{Tag: "v1.2.3", Digest: "sha256:abc"})
+	req, _ := http.NewRequest("POST", server.URL+"/admin/hooks/test/trigger", bytes.NewReader(body))
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+
+	var run Run
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&run))
+	assert.Equal(TriggerManual, run.Trigger)
+	assert.Equal("alice", run.User)
+	assert.Equal("v1.2.3", run.Tag)
+
+	job := <-jobs
+	assert.Equal(run.ID, job.Run.ID)
+	assert.Equal("connctd/test", job.Payload.Repo.RepoName)
+	assert.Equal("test", job.Payload.Repo.Name)
+	assert.Equal("sha256:abc", job.Payload.PushData.Digest)
+	assert.Equal("alice", job.Payload.PushData.Pusher)
+	assert.Equal("", job.Payload.CallbackUrl)
+
+	req, _ = http.NewRequest("POST", server.URL+"/admin/hooks/missing/trigger", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTriggerCommand(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	server, jobs := adminTestServer(t)
+	defer server.Close()
+	os.Setenv("KRANEN_PASSWORD", "secret")
+	defer os.Unsetenv("KRANEN_PASSWORD")
+
+	assert.Equal(0, triggerCommand([]string{"test", "-tag", "v2", "-url", server.URL, "-user", "alice"}))
+	job := <-jobs
+	assert.Equal("v2", job.Run.Tag)
+	assert.Equal("alice", job.Run.User)
+
+	assert.Equal(1, triggerCommand([]string{"test", "-url", server.URL, "-user", "bob"}))
+	assert.Equal(1, triggerCommand([]string{"missing", "-url", server.URL}))
+	assert.Equal(2, triggerCommand([]string{"-tag", "v2"}))
+
+	// The default ID <name>:<tag> contains the slash of the Docker Hub name
+	assert.Equal(0, triggerCommand([]string{"connctd/other:stable", "-url", server.URL, "-user", "alice"}))
+	job = <-jobs
+	assert.Equal("connctd/other:stable", job.Run.Hook)
+	assert.Equal("stable", job.Run.Tag)
+}
+
+func TestHookActionRoutes(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	server, jobs := adminTestServer(t)
+	defer server.Close()
+	status := func(path string) int {
+		req, _ := http.NewRequest("POST", server.URL+path, nil)
+		req.SetBasicAuth("alice", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(http.StatusAccepted, status("/admin/hooks/connctd/other:stable/trigger"))
+	assert.Equal("connctd/other:stable", (<-jobs).Run.Hook)
+	assert.Equal(http.StatusAccepted, status(hookActionURL("", "connctd/other:stable", "trigger")))
+	assert.Equal("connctd/other:stable", (<-jobs).Run.Hook)
+	assert.Equal(http.StatusAccepted, status("/admin/hooks/connctd%2Fother:stable/trigger"))
+	assert.Equal("connctd/other:stable", (<-jobs).Run.Hook)
+	assert.Equal(http.StatusNotFound, status("/admin/hooks/connctd/other:stable/rollback"))
+	assert.Equal(http.StatusNotFound, status("/admin/hooks/connctd/other:stable/deploy"))
+	assert.Equal(http.StatusNotFound, status("/admin/hooks/trigger"))
+}
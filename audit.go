@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditAccepted = "accepted"
+	AuditRejected = "rejected"
+
+	sourceAdmin = "admin"
+
+	// Reasons for rejections which are not counted by the webhook rejection metric
+	rejectUnauthorized = "unauthorized"
+	rejectUnknownHook  = "unknown_hook"
+	rejectBadRequest   = "bad_request"
+	rejectQueueError   = "queue_error"
+	rejectNoRollback   = "no_rollback"
+)
+
+// AuditEntry records one attempt to trigger a deployment
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	SourceIP string    `json:"source_ip"`
+	// ForwardedFor is the X-Forwarded-For header, if the request passed a proxy
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	// Source is dockerhub for webhooks and admin for manual triggers and rollbacks
+	Source string `json:"source"`
+	// KeyHash identifies the API key without revealing it
+	KeyHash   string `json:"key_hash,omitempty"`
+	User      string `json:"user,omitempty"`
+	Hook      string `json:"hook,omitempty"`
+	Repo      string `json:"repo,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+	Decision  string `json:"decision"`
+	Reason    string `json:"reason,omitempty"`
+	RunID     string `json:"run_id,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to a file, which is rotated by size and age,
+// and optionally sends them to syslog
+type auditLog struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	file    *os.File
+	size    int64
+	started time.Time
+	syslog  io.Writer
+}
+
+// audit is nil if auditing is disabled
+var audit *auditLog
+
+func openAuditLog(path string, maxSize int64, maxAge time.Duration) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	a.started = time.Now()
+	if a.size > 0 {
+		a.started = firstEntryTime(a.path, info.ModTime())
+	}
+	return nil
+}
+
+// firstEntryTime returns the time of the oldest entry in the file
+func firstEntryTime(path string, fallback time.Time) time.Time {
+	file, err := os.Open(path)
+	if err != nil {
+		return fallback
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return fallback
+	}
+	var entry AuditEntry
+	if json.Unmarshal(line, &entry) != nil || entry.Time.IsZero() {
+		return fallback
+	}
+	return entry.Time
+}
+
+// rotate renames the current file by appending the time and starts a new one
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	rotated := a.path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Record appends the entry to the audit log, errors are logged only
+func (a *auditLog) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Can't encode audit entry", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+	if a.size > 0 && ((a.maxSize > 0 && a.size+int64(len(line)) > a.maxSize) || (a.maxAge > 0 && time.Since(a.started) > a.maxAge)) {
+		if err := a.rotate(); err != nil {
+			logger.Error("Can't rotate audit log", "path", a.path, "error", err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logger.Error("Can't write audit log", "path", a.path, "error", err)
+	}
+	if a.syslog != nil {
+		if _, err := a.syslog.Write(line[:len(line)-1]); err != nil {
+			logger.Error("Can't write audit entry to syslog", "error", err)
+		}
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	return a.file.Close()
+}
+
+// hashKey returns a short SHA-256 hash of the API key
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:8])
+}
+
+func newAuditEntry(r *http.Request, source string) AuditEntry {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return AuditEntry{
+		Time:         time.Now(),
+		SourceIP:     ip,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Source:       source,
+		RequestID:    requestIDFrom(r.Context()),
+	}
+}
+
+func (e *AuditEntry) reject(reason string) {
+	e.Decision = AuditRejected
+	e.Reason = reason
+}
+
+func (e *AuditEntry) accept(run *Run) {
+	e.Decision = AuditAccepted
+	e.Hook = run.Hook
+	e.Repo = run.Repo
+	e.Tag = run.Tag
+	e.RunID = run.ID
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-audit-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	entry := AuditEntry{Time: time.Now(), Source: sourceDockerHub, Hook: "test", Decision: AuditAccepted, RunID: strings.Repeat("x", 100)}
+	line, _ := json.Marshal(entry)
+	path := filepath.Join(dir, "audit.log")
+	log, err := openAuditLog(path, int64(2*(len(line)+1)), 0)
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		log.Record(entry)
+	}
+	assert.Nil(log.Close())
+	files, _ := filepath.Glob(path + "*")
+	assert.Equal(2, len(files))
+	assert.Equal(1, len(readAuditLog(t, path)))
+
+	// The age of a reopened log is determined by its first entry
+	ioutil.WriteFile(path, []byte(`{"time":"2020-01-01T00:00:00Z","decision":"accepted"}`+"\n"), 0600)
+	log, err = openAuditLog(path, 0, 24*time.Hour)
+	assert.Nil(err)
+	log.Record(AuditEntry{Decision: AuditRejected})
+	assert.Nil(log.Close())
+	files, _ = filepath.Glob(path + "*")
+	assert.Equal(3, len(files))
+	entries := readAuditLog(t, path)
+	assert.Equal(1, len(entries))
+	assert.Equal(AuditRejected, entries[0].Decision)
+}
+
+func TestWebhookAudit(t *testing.T) {
+	assert := assert.New(t)
+	defer startTestExecutor(t)()
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+	defer func(previous *auditLog) { audit = previous }(audit)
+
+	dir, err := ioutil.TempDir("", "kranen-audit-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	audit, err = openAuditLog(filepath.Join(dir, "audit.log"), 0, 0)
+	assert.Nil(err)
+	configs = []RepoConfig{{ApiKey: "foobaz", Name: "connctd/test", Tag: "latest", Script: writeScript(t, dir, "deploy.sh", "true\n")}}
+
+	router := httprouter.New()
+	router.POST("/docker/:apikey", hook)
+	for _, apiKey := range []string{"unknown", "foobaz"} {
+		req := httptest.NewRequest("POST", "/docker/"+apiKey, strings.NewReader(successPayload))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	pendingJobs.Wait()
+	assert.Nil(audit.Close())
+
+	entries := readAuditLog(t, filepath.Join(dir, "audit.log"))
+	assert.Equal(2, len(entries))
+	assert.Equal(AuditRejected, entries[0].Decision)
+	assert.Equal(rejectUnknownKey, entries[0].Reason)
+	assert.Equal(hashKey("unknown"), entries[0].KeyHash)
+	assert.Equal("", entries[0].RunID)
+
+	accepted := entries[1]
+	assert.Equal(AuditAccepted, accepted.Decision)
+	assert.Equal("192.0.2.1", accepted.SourceIP)
+	assert.Equal("198.51.100.7", accepted.ForwardedFor)
+	assert.Equal(sourceDockerHub, accepted.Source)
+	assert.Equal(hashKey("foobaz"), accepted.KeyHash)
+	assert.NotContains(accepted.KeyHash, "foobaz")
+	assert.Equal("connctd/test", accepted.Repo)
+	assert.Equal("latest", accepted.Tag)
+	_, found := history.Get(accepted.RunID)
+	assert.True(found)
+}
+
+func TestAdminAudit(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	defer func(previous *auditLog) { audit = previous }(audit)
+	server, jobs := adminTestServer(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kranen-audit-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	audit, err = openAuditLog(filepath.Join(dir, "audit.log"), 0, 0)
+	assert.Nil(err)
+
+	for _, password := range []string{"wrong", "secret"} {
+		req, _ := http.NewRequest("POST", server.URL+"/admin/hooks/test/trigger", nil)
+		req.SetBasicAuth("alice", password)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err)
+		resp.Body.Close()
+	}
+	job := <-jobs
+	assert.Nil(audit.Close())
+
+	entries := readAuditLog(t, filepath.Join(dir, "audit.log"))
+	assert.Equal(2, len(entries))
+	assert.Equal(AuditRejected, entries[0].Decision)
+	assert.Equal(rejectUnauthorized, entries[0].Reason)
+	assert.Equal(sourceAdmin, entries[1].Source)
+	assert.Equal("alice", entries[1].User)
+	assert.Equal("test", entries[1].Hook)
+	assert.Equal(AuditAccepted, entries[1].Decision)
+	assert.Equal(job.Run.ID, entries[1].RunID)
+}
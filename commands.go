@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// runCommand executes a command given on the command line instead of starting the server
+// and returns the exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "rollback":
+		return rollbackCommand(args)
+	case "trigger":
+		return triggerCommand(args)
+	case "config":
+		return configCommand(args)
+	}
+	logger.Error("Unknown command", "command", name)
+	return 2
+}
+
+// defaultServerURL derives the URL of the running kranen from the -httpAddress flag
+func defaultServerURL() string {
+	scheme := "http"
+	if *certificatePath != "" || *autoTLS {
+		scheme = "https"
+	}
+	address := *httpAddress
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	return fmt.Sprintf("%s://%s", scheme, address)
+}
+
+// triggerCommand asks a running kranen to execute a hook via the admin API. The password
+// is read from the KRANEN_PASSWORD environment variable.
+func triggerCommand(args []string) int {
+	flags := flag.NewFlagSet("trigger", flag.ContinueOnError)
+	tag := flags.String("tag", "", "Tag to deploy, defaults to the tag of the hook")
+	digest := flags.String("digest", "", "Digest of the image to deploy")
+	serverURL := flags.String("url", defaultServerURL(), "URL of the running kranen")
+	user := flags.String("user", os.Getenv("USER"), "Admin user")
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(os.Stderr, "Usage: kranen -config <path/to/config/yaml> trigger <hook> [-tag <tag>] [-digest <digest>]")
+		return 2
+	}
+	hookID := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if _, found := findHook(hookID); !found {
+		logger.Error("Hook does not exist", "hook", hookID)
+		return 1
+	}
+
+	body, _ := json.Marshal(TriggerRequest{Tag: *tag, Digest: *digest})
+	run, err := postHookAction(*serverURL, *user, hookID, "trigger", body)
+	if err != nil {
+		logger.Error("Trigger failed", "error", err)
+		return 1
+	}
+	fmt.Printf("Queued run %s for hook %s with tag %s\n", run.ID, run.Hook, run.Tag)
+	return 0
+}
+
+// postHookAction calls an action of the hook via the admin API of a running kranen and returns
+// the queued run. The password is read from the KRANEN_PASSWORD environment variable.
+func postHookAction(serverURL, user, hookID, action string, body []byte) (Run, error) {
+	var run Run
+	req, err := http.NewRequest("POST", hookActionURL(serverURL, hookID, action), bytes.NewReader(body))
+	if err != nil {
+		return run, fmt.Errorf("Can't create request: %+v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(user, os.Getenv("KRANEN_PASSWORD"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return run, fmt.Errorf("Can't reach kranen: %+v", err)
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return run, fmt.Errorf("Status %d: %s", resp.StatusCode, strings.TrimSpace(string(response)))
+	}
+	if err := json.Unmarshal(response, &run); err != nil {
+		return run, fmt.Errorf("Can't parse response: %+v", err)
+	}
+	return run, nil
+}
+
+// hookActionURL returns the admin API URL of the action of the hook. The slash of Docker Hub names
+// is kept, the router matches it, everything else is escaped.
+func hookActionURL(serverURL, hookID, action string) string {
+	segments := strings.Split(hookID, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("%s/admin/hooks/%s/%s", strings.TrimRight(serverURL, "/"), strings.Join(segments, "/"), action)
+}
+
+func configCommand(args []string) int {
+	if len(args) > 0 && args[0] == "migrate" {
+		return migrateCommand(args[1:])
+	}
+	if len(args) == 1 && args[0] == "dump" {
+		return dumpCommand()
+	}
+	fmt.Fprintln(os.Stderr, "Usage: kranen -config <path/to/config/yaml> config migrate [-o <path>] | config dump")
+	return 2
+}
+
+// dumpCommand prints the effective config, i.e. the hooks with templates and defaults applied
+// and the settings from the config file and flags
+func dumpCommand() int {
+	content, err := yaml.Marshal(effectiveConfig())
+	if err != nil {
+		logger.Error("Can't encode config", "error", err)
+		return 1
+	}
+	os.Stdout.Write(content)
+	return 0
+}
+
+// migrateCommand rewrites a version 1 config file in the current format. The original file is
+// kept with the suffix .v1 and settings given as flags are moved into the file.
+func migrateCommand(args []string) int {
+	flags := flag.NewFlagSet("config migrate", flag.ContinueOnError)
+	output := flags.String("o", "", "Write the migrated config to this file instead of replacing the config file, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	config, version, err := loadConfig(*configFile)
+	if err != nil {
+		logger.Error("Can't load config", "error", err)
+		return 1
+	}
+	if version == configVersion {
+		fmt.Printf("%s already has version %d\n", *configFile, configVersion)
+		return 0
+	}
+	// The migrated config keeps the format of the config file unless written to a file of another format
+	format := *output
+	if format == "" || format == "-" {
+		format = *configFile
+	}
+	content, err := encodeConfig(format, migrateConfig(config.Hooks, explicitFlags()))
+	if err != nil {
+		logger.Error("Can't encode config", "error", err)
+		return 1
+	}
+	switch *output {
+	case "-":
+		os.Stdout.Write(content)
+		return 0
+	case "":
+		original, err := ioutil.ReadFile(*configFile)
+		if err == nil {
+			err = writeFileAtomic(*configFile+".v1", original, 0600)
+		}
+		if err != nil {
+			logger.Error("Can't back up config", "error", err)
+			return 1
+		}
+		*output = *configFile
+	}
+	if err := writeFileAtomic(*output, content, 0600); err != nil {
+		logger.Error("Can't write config", "error", err)
+		return 1
+	}
+	fmt.Printf("Migrated %s to version %d in %s\n", *configFile, configVersion, *output)
+	return 0
+}
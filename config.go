@@ -1,8 +1,182 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
 type RepoConfig struct {
-	ApiKey string `yaml:"api_key"`
-	Name   string `yaml:"name"`
-	Script string `yaml:"script"`
-	Tag    string `yaml:"tag"`
+	// ID identifies the hook in logs and the run history, defaults to <name>:<tag>
+	ID string `yaml:"id,omitempty"`
+	// Extends names a template in the config file whose fields are used if the hook doesn't set them
+	Extends string          `yaml:"extends,omitempty"`
+	ApiKey  string          `yaml:"api_key,omitempty"`
+	Name    string          `yaml:"name,omitempty"`
+	Script  string          `yaml:"script,omitempty"`
+	Tag     string          `yaml:"tag,omitempty"`
+	Forward []ForwardConfig `yaml:"forward,omitempty"`
+	GitOps  *GitOpsConfig   `yaml:"gitops,omitempty"`
+	Steps   []StepConfig    `yaml:"steps,omitempty"`
+	// OnFailure is executed if the pipeline fails, e.g. to redeploy .Previous.Tag
+	OnFailure *StepConfig `yaml:"on_failure,omitempty"`
+	// Timeout applies to all steps which don't set their own timeout, including on_failure
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// ScriptPrefix is put in front of every script of the hook, e.g. a wrapper preparing the environment
+	ScriptPrefix string `yaml:"script_prefix,omitempty"`
+	// Retry executes failed pipelines again
+	Retry *RetryConfig `yaml:"retry,omitempty"`
+	// Debounce collapses webhook events received within this window into one run of the latest event
+	Debounce time.Duration `yaml:"debounce,omitempty"`
+	// Notify lists chat webhooks informed about runs of this hook
+	Notify []NotifyConfig `yaml:"notify,omitempty"`
+}
+
+// StepConfig describes one step of a pipeline. Exactly one of Script, Forward and GitOps must be set
+type StepConfig struct {
+	Name    string         `yaml:"name,omitempty"`
+	Script  string         `yaml:"script,omitempty"`
+	Forward *ForwardConfig `yaml:"forward,omitempty"`
+	GitOps  *GitOpsConfig  `yaml:"gitops,omitempty"`
+	Timeout time.Duration  `yaml:"timeout,omitempty"`
+	// Env contains additional environment variables for scripts, values are templates
+	Env             map[string]string `yaml:"env,omitempty"`
+	ContinueOnError bool              `yaml:"continue_on_error,omitempty"`
+}
+
+// HookID returns the configured ID or derives one from the repository name and tag
+func (c RepoConfig) HookID() string {
+	if c.ID != "" {
+		return c.ID
+	}
+	return c.Name + ":" + c.Tag
+}
+
+// Pipeline returns the steps to execute for this hook. Hooks without steps are
+// converted into a pipeline of their script, gitops and forward actions
+func (c RepoConfig) Pipeline() []StepConfig {
+	if len(c.Steps) > 0 {
+		steps := make([]StepConfig, len(c.Steps))
+		for i, step := range c.Steps {
+			if step.Name == "" {
+				step.Name = fmt.Sprintf("step%d", i+1)
+			}
+			steps[i] = c.withHookSettings(step)
+		}
+		return steps
+	}
+	steps := make([]StepConfig, 0, 2+len(c.Forward))
+	if c.Script != "" {
+		steps = append(steps, c.withHookSettings(StepConfig{Name: "script", Script: c.Script}))
+	}
+	if c.GitOps != nil {
+		steps = append(steps, c.withHookSettings(StepConfig{Name: "gitops", GitOps: c.GitOps}))
+	}
+	for i := range c.Forward {
+		steps = append(steps, c.withHookSettings(StepConfig{Name: fmt.Sprintf("forward%d", i+1), Forward: &c.Forward[i]}))
+	}
+	return steps
+}
+
+// withHookSettings sets the hook's timeout on the step unless the step has its own and puts the
+// hook's script prefix in front of the step's script
+func (c RepoConfig) withHookSettings(step StepConfig) StepConfig {
+	if step.Timeout == 0 {
+		step.Timeout = c.Timeout
+	}
+	if step.Script != "" && c.ScriptPrefix != "" {
+		step.Script = c.ScriptPrefix + " " + step.Script
+	}
+	return step
+}
+
+func (c RepoConfig) validate() error {
+	if len(c.Steps) > 0 && (c.Script != "" || c.GitOps != nil || len(c.Forward) > 0) {
+		return fmt.Errorf("Hook %s: steps can't be combined with script, gitops or forward", c.HookID())
+	}
+	names := make(map[string]bool)
+	for _, step := range c.Pipeline() {
+		actions := 0
+		if step.Script != "" {
+			actions++
+		}
+		if step.Forward != nil {
+			actions++
+		}
+		if step.GitOps != nil {
+			actions++
+		}
+		if actions != 1 {
+			return fmt.Errorf("Hook %s: step %s needs exactly one of script, forward and gitops", c.HookID(), step.Name)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("Hook %s: duplicate step name %s", c.HookID(), step.Name)
+		}
+		names[step.Name] = true
+	}
+	if c.OnFailure != nil && c.OnFailure.Script == "" && c.OnFailure.Forward == nil && c.OnFailure.GitOps == nil {
+		return fmt.Errorf("Hook %s: on_failure needs one of script, forward and gitops", c.HookID())
+	}
+	for _, notifier := range c.Notify {
+		if err := notifier.validate(); err != nil {
+			return fmt.Errorf("Hook %s: %+v", c.HookID(), err)
+		}
+	}
+	if c.Retry != nil {
+		if c.Retry.MaxAttempts < 1 {
+			return fmt.Errorf("Hook %s: retry needs max_attempts of at least 1", c.HookID())
+		}
+		if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+			return fmt.Errorf("Hook %s: retry jitter must be between 0 and 1", c.HookID())
+		}
+	}
+	return nil
+}
+
+// RetryConfig describes how often and when a failed pipeline is executed again
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts including the first one
+	MaxAttempts int `yaml:"max_attempts,omitempty"`
+	// Backoff is the delay before the first retry, it doubles with every further retry
+	Backoff    time.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
+	// Jitter randomly changes the delay by up to this fraction, e.g. 0.2 for +/-20%
+	Jitter float64 `yaml:"jitter,omitempty"`
+	// ExitCodes limits retries to scripts failing with one of these exit codes, all failures are retried if empty
+	ExitCodes []int `yaml:"exit_codes,omitempty"`
+}
+
+// ForwardConfig describes a downstream endpoint the received event is relayed to
+type ForwardConfig struct {
+	URLs    []string          `yaml:"urls,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Body is a template for the request body, the original payload is sent if empty
+	Body string `yaml:"body,omitempty"`
+	// Secret is used to sign the body with HMAC-SHA256
+	Secret  string        `yaml:"secret,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	Retries int           `yaml:"retries,omitempty"`
+}
+
+// GitOpsConfig describes a git repository containing manifests which should be updated
+// instead of deploying directly
+type GitOpsConfig struct {
+	// Repository is a local path or (SSH) URL of the repository
+	Repository string `yaml:"repository,omitempty"`
+	Branch     string `yaml:"branch,omitempty"`
+	// Workdir is the directory the repository is cloned to, defaults to a directory in the temp dir
+	Workdir string       `yaml:"workdir,omitempty"`
+	SSHKey  string       `yaml:"ssh_key,omitempty"`
+	Files   []GitOpsFile `yaml:"files,omitempty"`
+	// Message is a template for the commit message
+	Message     string `yaml:"message,omitempty"`
+	AuthorName  string `yaml:"author_name,omitempty"`
+	AuthorEmail string `yaml:"author_email,omitempty"`
+	// Retries is the number of attempts if pushing fails because of a conflict
+	Retries int `yaml:"retries,omitempty"`
+}
+
+// GitOpsFile maps key paths in a YAML file to templates of their new values
+type GitOpsFile struct {
+	Path string            `yaml:"path,omitempty"`
+	Set  map[string]string `yaml:"set,omitempty"`
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard/*.html
+var dashboardFiles embed.FS
+
+var dashboardFuncs = template.FuncMap{
+	"duration": formatRunDuration,
+	"time":     formatTime,
+}
+
+var (
+	dashboardIndex = template.Must(template.New("layout.html").Funcs(dashboardFuncs).
+			ParseFS(dashboardFiles, "dashboard/layout.html", "dashboard/index.html"))
+	dashboardRun = template.Must(template.New("layout.html").Funcs(dashboardFuncs).
+			ParseFS(dashboardFiles, "dashboard/layout.html", "dashboard/run.html"))
+)
+
+// HookSummary describes a configured hook without revealing its API key
+type HookSummary struct {
+	ID     string
+	Name   string
+	Tag    string
+	ApiKey string
+	Steps  []string
+}
+
+func registerDashboardRoutes(router *httprouter.Router, users adminUsers) {
+	router.GET("/dashboard", requireAdmin(users, dashboardHandler))
+	router.GET("/dashboard/runs/:id", requireAdmin(users, dashboardRunHandler))
+}
+
+// maskKey shows only the first characters of the API key
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:2] + strings.Repeat("*", 6)
+}
+
+func hookSummaries() []HookSummary {
+	hooks := make([]HookSummary, 0, len(configs))
+	for _, config := range configs {
+		hook := HookSummary{ID: config.HookID(), Name: config.Name, Tag: config.Tag, ApiKey: maskKey(config.ApiKey)}
+		for _, step := range config.Pipeline() {
+			hook.Steps = append(hook.Steps, step.Name)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// formatRunDuration returns how long the run took or is running for
+func formatRunDuration(run Run) string {
+	if run.Started.IsZero() {
+		return ""
+	}
+	finished := run.Finished
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	return finished.Sub(run.Started).Round(time.Second).String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func renderDashboard(w http.ResponseWriter, tpl *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tpl.Execute(w, data); err != nil {
+		logger.Warn("Can't render dashboard", "error", err)
+	}
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	renderDashboard(w, dashboardIndex, struct {
+		User  string
+		Hooks []HookSummary
+		Runs  []Run
+	}{user, hookSummaries(), history.List()})
+}
+
+func dashboardRunHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	run, found := history.Get(ps.ByName("id"))
+	if !found {
+		http.Error(w, fmt.Sprintf("Run %s does not exist", ps.ByName("id")), http.StatusNotFound)
+		return
+	}
+	log, _ := history.Log(run.ID)
+	renderDashboard(w, dashboardRun, struct {
+		User string
+		Run  Run
+		Log  []LogLine
+	}{user, run, log})
+}
+
+func getRunLog(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	log, found := history.Log(ps.ByName("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Run %s does not exist", ps.ByName("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, log)
+}
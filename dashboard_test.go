@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	server, _ := adminTestServer(t)
+	defer server.Close()
+
+	run := &Run{ID: newRunID(), Hook: "test", Repo: "connctd/test", Tag: "latest", Trigger: TriggerWebhook,
+		Status: StatusRunning, Queued: time.Now(), Started: time.Now()}
+	history.add(run)
+	history.appendLog(run, LogLine{Time: time.Now(), Step: "deploy", Stream: "stderr", Line: "pulling <image>"})
+
+	get := func(path string) (int, string) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.SetBasicAuth("alice", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	resp, err := http.Get(server.URL + "/dashboard")
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	status, body := get("/dashboard")
+	assert.Equal(http.StatusOK, status)
+	assert.Contains(body, "fo******")
+	assert.NotContains(body, "foobaz")
+	assert.Contains(body, `<a href="/dashboard/runs/`+run.ID+`">`)
+
+	status, body = get("/dashboard/runs/" + run.ID)
+	assert.Equal(http.StatusOK, status)
+	assert.Contains(body, "[deploy] pulling &lt;image&gt;")
+	status, _ = get("/dashboard/runs/unknown")
+	assert.Equal(http.StatusNotFound, status)
+
+	status, body = get("/admin/runs/" + run.ID + "/log")
+	assert.Equal(http.StatusOK, status)
+	var log []LogLine
+	assert.Nil(json.Unmarshal([]byte(body), &log))
+	assert.Len(log, 1)
+	assert.Equal("pulling <image>", log[0].Line)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer holds back webhook jobs of hooks with a debounce window. The first event of a hook
+// opens the window, later events within the window replace the waiting job, and the latest job
+// is queued when the window closes.
+type debouncer struct {
+	sync.Mutex
+	waiting map[string]Job
+}
+
+var debounce = newDebouncer()
+
+func newDebouncer() *debouncer {
+	return &debouncer{waiting: make(map[string]Job)}
+}
+
+func (d *debouncer) add(job Job) {
+	d.Lock()
+	defer d.Unlock()
+	hook := job.Run.Hook
+	if previous, found := d.waiting[hook]; found {
+		supersede(previous, job)
+		d.waiting[hook] = job
+		return
+	}
+	job.logger().Info("Waiting for further events", "debounce", job.Config.Debounce)
+	d.waiting[hook] = job
+	time.AfterFunc(job.Config.Debounce, func() {
+		d.release(hook)
+	})
+}
+
+// release queues the latest job of the hook
+func (d *debouncer) release(hook string) {
+	d.Lock()
+	job := d.waiting[hook]
+	delete(d.waiting, hook)
+	d.Unlock()
+	if draining.Load() {
+		// The job stays in the on-disk queue and is executed after the restart
+		skipJob(job)
+		return
+	}
+	queueJob(job)
+}
+
+// supersede records that the job is replaced by a later one and removes it from the queue
+func supersede(job, by Job) {
+	history.update(job.Run, func(run *Run) {
+		run.Status = StatusSuperseded
+		run.SupersededBy = by.Run.ID
+		run.Finished = time.Now()
+	})
+	job.logger().Info("Run superseded by later event", "superseded_by", by.Run.ID, "tag", by.Run.Tag)
+	if err := jobQueue.Ack(job); err != nil {
+		job.logger().Error("Can't remove job from queue", "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDebounceCollapsesEvents(t *testing.T) {
+	assert := assert.New(t)
+	defer startTestExecutor(t)()
+
+	dir, err := ioutil.TempDir("", "kranen-debounce-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	deployed := filepath.Join(dir, "deployed")
+	deploy := writeScript(t, dir, "deploy.sh", "echo $1 >> "+deployed+"\n")
+	config := RepoConfig{ID: "test", Script: deploy + " {{.Hub.PushData.Tag}}", Debounce: 100 * time.Millisecond}
+
+	var jobs []Job
+	for _, tag := range []string{"v1", "v2", "v3"} {
+		job := testJob(t, config)
+		job.Run.Trigger = TriggerWebhook
+		job.Payload.PushData.Tag = tag
+		assert.Nil(executeScript(job))
+		jobs = append(jobs, job)
+	}
+	waitForStatus(t, jobs[2].Run.ID, StatusSucceeded)
+	for i, job := range jobs[:2] {
+		run, _ := history.Get(job.Run.ID)
+		assert.Equal(StatusSuperseded, run.Status)
+		assert.Equal(jobs[i+1].Run.ID, run.SupersededBy)
+	}
+	content, err := ioutil.ReadFile(deployed)
+	assert.Nil(err)
+	assert.Equal("v3\n", string(content))
+
+	// Events after the window start a new run
+	job := testJob(t, config)
+	job.Run.Trigger = TriggerWebhook
+	job.Payload.PushData.Tag = "v4"
+	assert.Nil(executeScript(job))
+	waitForStatus(t, job.Run.ID, StatusSucceeded)
+	content, err = ioutil.ReadFile(deployed)
+	assert.Nil(err)
+	assert.Equal("v3\nv4\n", string(content))
+	pendingJobs.Wait()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SMTPStartTLS = "starttls"
+	SMTPImplicit = "implicit"
+	SMTPNone     = "none"
+
+	defaultEmailSubject = "[kranen] {{.Repo}}:{{.Tag}} {{.Event}}"
+	defaultEmailBody    = `Run {{.RunID}} of hook {{.Hook}}: {{.Event}}
+
+Repository: {{.Repo}}
+Tag:        {{.Tag}}
+Pusher:     {{.Pusher}}
+Trigger:    {{.Trigger}}
+{{if .Duration}}Duration:   {{.Duration}}
+{{end}}{{if .Error}}Error:      {{.Error}}
+{{end}}{{if .LogTail}}
+Log excerpt:
+{{.LogTail}}
+{{end}}`
+)
+
+// SMTPConfig describes the mail server used by email notifiers
+type SMTPConfig struct {
+	Host string `yaml:"host,omitempty"`
+	// Port defaults to 587 for starttls, 465 for implicit and 25 for none
+	Port int `yaml:"port,omitempty"`
+	// TLS is starttls (default), implicit or none
+	TLS      string `yaml:"tls,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+func (n NotifyConfig) validateEmail() error {
+	if n.SMTP == nil || n.SMTP.Host == "" {
+		return fmt.Errorf("Notifier email needs an smtp host")
+	}
+	switch n.SMTP.TLS {
+	case "", SMTPStartTLS, SMTPImplicit, SMTPNone:
+	default:
+		return fmt.Errorf("Notifier email: unknown tls mode %q, use starttls, implicit or none", n.SMTP.TLS)
+	}
+	if n.From == "" || len(n.To) == 0 {
+		return fmt.Errorf("Notifier email needs from and to addresses")
+	}
+	return nil
+}
+
+func (s SMTPConfig) address() string {
+	port := s.Port
+	if port == 0 {
+		switch s.TLS {
+		case SMTPImplicit:
+			port = 465
+		case SMTPNone:
+			port = 25
+		default:
+			port = 587
+		}
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+// sendEmail mails the notification to all recipients, the full log is attached if AttachLog is set
+func (n NotifyConfig) sendEmail(data NotificationData, log []LogLine) error {
+	subjectTemplate := n.Subjects[data.Event]
+	if subjectTemplate == "" {
+		subjectTemplate = defaultEmailSubject
+	}
+	subject, err := renderTemplate("email subject", subjectTemplate, data)
+	if err != nil {
+		return err
+	}
+	bodyTemplate := n.Templates[data.Event]
+	if bodyTemplate == "" {
+		bodyTemplate = defaultEmailBody
+	}
+	body, err := renderTemplate("email body", bodyTemplate, data)
+	if err != nil {
+		return err
+	}
+	var attachment []byte
+	if n.AttachLog {
+		attachment = formatLog(log)
+	}
+	message, err := buildEmail(n.From, n.To, subject, body, "kranen-"+data.RunID+".log", attachment)
+	if err != nil {
+		return err
+	}
+
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = defaultNotifyTimeout
+	}
+	return n.SMTP.send(n.From, n.To, message, timeout)
+}
+
+func (s SMTPConfig) send(from string, to []string, message []byte, timeout time.Duration) error {
+	tlsConfig := &tls.Config{ServerName: s.Host}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if s.TLS == SMTPImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address(), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.address())
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if s.TLS == "" || s.TLS == SMTPStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// formatLog returns the log as text, it is never nil so an empty log is still attached
+func formatLog(log []LogLine) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	for _, line := range log {
+		fmt.Fprintf(buffer, "%s %s %s: %s\n", line.Time.Format(time.RFC3339), line.Step, line.Stream, line.Line)
+	}
+	return buffer.Bytes()
+}
+
+// buildEmail creates a plain text email, which is a multipart message if there is an attachment
+func buildEmail(from string, to []string, subject, body, filename string, attachment []byte) ([]byte, error) {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	if attachment == nil {
+		fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&message, "Content-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64(&message, []byte(body))
+		return message.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&message)
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	text, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64(text, []byte(body))
+	file, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64(file, attachment)
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
+
+// writeBase64 writes the content base64 encoded in lines of 76 characters
+func writeBase64(w io.Writer, content []byte) {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn is a minimal SMTP server accepting every message
+type smtpStandIn struct {
+	listener   net.Listener
+	auth       []string
+	recipients []string
+	messages   chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener, messages: make(chan string, 10)}
+	go s.serve()
+	return s
+}
+
+func (s *smtpStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.handle(conn)
+	}
+}
+
+func (s *smtpStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+		switch verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = append(s.auth, command)
+			reply("235 Authenticated")
+		case "MAIL":
+			reply("250 OK")
+		case "RCPT":
+			s.recipients = append(s.recipients, command)
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.messages <- data.String()
+			reply("250 Queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func TestEmailNotifications(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+
+	server := newSMTPStandIn(t)
+	defer server.listener.Close()
+	_, port, _ := net.SplitHostPort(server.listener.Addr().String())
+
+	dir, err := ioutil.TempDir("", "kranen-email-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	fail := writeScript(t, dir, "fail.sh", "echo pulling image\necho no space left on device >&2\nexit 1\n")
+
+	smtpConfig := &SMTPConfig{Host: "127.0.0.1", TLS: SMTPNone, Username: "kranen", Password: "secret"}
+	smtpConfig.Port, _ = strconv.Atoi(port)
+	config := RepoConfig{
+		ID:     "test",
+		Script: fail,
+		Notify: []NotifyConfig{{
+			Type:      NotifyEmail,
+			Events:    []string{EventFailed},
+			SMTP:      smtpConfig,
+			From:      "kranen@example.com",
+			To:        []string{"ops@example.com", "dev@example.com"},
+			Subjects:  map[string]string{EventFailed: "Production deploy of {{.Tag}} failed"},
+			AttachLog: true,
+		}},
+	}
+	assert.Nil(config.validate())
+	job := testJob(t, config)
+	job.Run.Repo, job.Run.Tag = "connctd/test", "latest"
+	assert.False(runPipeline(context.Background(), job))
+
+	raw := <-server.messages
+	assert.Len(server.auth, 1)
+	assert.Equal([]string{"RCPT TO:<ops@example.com>", "RCPT TO:<dev@example.com>"}, server.recipients)
+	message, err := mail.ReadMessage(strings.NewReader(raw))
+	assert.Nil(err)
+	assert.Equal("Production deploy of latest failed", message.Header.Get("Subject"))
+	assert.Equal("ops@example.com, dev@example.com", message.Header.Get("To"))
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	assert.Nil(err)
+	assert.Equal("multipart/mixed", mediaType)
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	text, err := parts.NextPart()
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, text))
+	assert.Contains(string(body), "Run "+job.Run.ID+" of hook test: failed")
+	assert.Contains(string(body), "Pusher:     connctddev")
+	assert.Contains(string(body), "Error:      exit status 1")
+	assert.Contains(string(body), "no space left on device")
+	attachment, err := parts.NextPart()
+	assert.Nil(err)
+	assert.Equal("kranen-"+job.Run.ID+".log", attachment.FileName())
+	log, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	assert.Contains(string(log), "script stdout: pulling image")
+	assert.Contains(string(log), "script stderr: no space left on device")
+
+	assert.NotNil(NotifyConfig{Type: NotifyEmail, From: "kranen@example.com", To: []string{"ops@example.com"}}.validate())
+	assert.NotNil(NotifyConfig{Type: NotifyEmail, SMTP: &SMTPConfig{Host: "localhost"}}.validate())
+	assert.NotNil(NotifyConfig{Type: NotifyEmail, SMTP: &SMTPConfig{Host: "localhost", TLS: "ssl"}, From: "a", To: []string{"b"}}.validate())
+}
+
+func TestUnreachableMailServerDoesNotBlockRuns(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+
+	// The mail server accepts connections but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	connections := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections <- conn
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	chat := &chatStandIn{}
+	chatServer := httptest.NewServer(chat)
+	defer chatServer.Close()
+	dir, err := ioutil.TempDir("", "kranen-email-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	smtpConfig := &SMTPConfig{Host: "127.0.0.1", TLS: SMTPNone}
+	smtpConfig.Port, _ = strconv.Atoi(port)
+	config := RepoConfig{
+		ID:     "test",
+		Script: writeScript(t, dir, "deploy.sh", "true\n"),
+		Notify: []NotifyConfig{
+			{Type: NotifyEmail, Events: []string{EventSucceeded}, SMTP: smtpConfig, From: "kranen@example.com", To: []string{"ops@example.com"}, Timeout: time.Minute},
+			{Type: NotifySlack, URL: chatServer.URL},
+		},
+	}
+	assert.Nil(config.validate())
+	started := time.Now()
+	assert.True(runPipeline(context.Background(), testJob(t, config)))
+	assert.True(time.Since(started) < 10*time.Second)
+
+	// Chat notifications are sent while the email waits for the mail server
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		chat.Lock()
+		sent := len(chat.messages)
+		chat.Unlock()
+		if sent == 2 || time.Now().After(deadline) {
+			assert.Equal(2, sent)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(waitForNotifications(10 * time.Millisecond))
+
+	listener.Close()
+	(<-connections).Close()
+	assert.True(waitForNotifications(10 * time.Second))
+}
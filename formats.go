@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configFormat decodes a config file into plain maps, lists and scalars and encodes them again.
+// unmarshal decodes the file into the config types, formats without it are decoded through YAML.
+type configFormat struct {
+	decode    func(content []byte) (interface{}, error)
+	encode    func(document interface{}) ([]byte, error)
+	unmarshal func(content []byte, out interface{}) error
+}
+
+// configFormats are the supported config file formats by file extension. Files with other
+// extensions given by -config or include are read as YAML.
+var configFormats = map[string]configFormat{
+	".yml":  {decodeYAML, yaml.Marshal, yaml.Unmarshal},
+	".yaml": {decodeYAML, yaml.Marshal, yaml.Unmarshal},
+	".json": {decodeJSON, encodeJSON, nil},
+	".toml": {decodeTOML, encodeTOML, nil},
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func formatOf(path string) configFormat {
+	if format, found := configFormats[strings.ToLower(filepath.Ext(path))]; found {
+		return format
+	}
+	return configFormats[".yaml"]
+}
+
+// isConfigFile reports if the file has the extension of a supported config format
+func isConfigFile(path string) bool {
+	_, found := configFormats[strings.ToLower(filepath.Ext(path))]
+	return found
+}
+
+// configDocument is a config file read by readConfigFile
+type configDocument struct {
+	content []byte
+	format  configFormat
+	// value is the content as plain maps, lists and scalars, see normalize
+	value interface{}
+}
+
+// readConfigFile reads a config file in the format given by its extension
+func readConfigFile(path string) (configDocument, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return configDocument{}, err
+	}
+	format := formatOf(path)
+	value, err := format.decode(content)
+	if err != nil {
+		return configDocument{}, err
+	}
+	return configDocument{content: content, format: format, value: normalize(value)}, nil
+}
+
+// decode checks the document against the type of out and decodes it. Unknown fields and values of
+// the wrong type are reported with their path, e.g. hooks[0].steps[1].timeout, so all formats are
+// validated the same way.
+func (d configDocument) decode(out interface{}) error {
+	if err := checkDocument(d.value, reflect.TypeOf(out), ""); err != nil {
+		return err
+	}
+	// YAML is decoded from the file, the normalized value would turn e.g. tag: 1.0 into "1"
+	if d.format.unmarshal != nil {
+		return d.format.unmarshal(d.content, out)
+	}
+	// Scalars of JSON and TOML are typed, so their documents are decoded by the YAML decoder, which
+	// knows how to decode durations
+	content, err := yaml.Marshal(d.value)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(content, out)
+}
+
+// encodeConfig encodes the value in the format of the file at path
+func encodeConfig(path string, value interface{}) ([]byte, error) {
+	content, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".toml":
+		document, err := decodeYAML(content)
+		if err != nil {
+			return nil, err
+		}
+		return formatOf(path).encode(normalize(document))
+	}
+	return content, nil
+}
+
+func decodeYAML(content []byte) (interface{}, error) {
+	var document interface{}
+	err := yaml.Unmarshal(content, &document)
+	return document, err
+}
+
+func decodeJSON(content []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, nil
+	}
+	var document interface{}
+	if err := json.Unmarshal(content, &document); err != nil {
+		if syntaxError, ok := err.(*json.SyntaxError); ok {
+			// The offset is the number of bytes read, including the invalid one
+			line, column := position(content, syntaxError.Offset-1)
+			return nil, fmt.Errorf("json: line %d, column %d: %s", line, column, syntaxError)
+		}
+		return nil, err
+	}
+	return document, nil
+}
+
+func encodeJSON(document interface{}) ([]byte, error) {
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
+
+func decodeTOML(content []byte) (interface{}, error) {
+	var document map[string]interface{}
+	if _, err := toml.Decode(string(content), &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func encodeTOML(document interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := toml.NewEncoder(&buffer).Encode(document)
+	return buffer.Bytes(), err
+}
+
+// position returns the line and column of the byte at offset, both starting at 1
+func position(content []byte, offset int64) (int, int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	} else if offset < 0 {
+		offset = 0
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// normalize converts the maps of all decoders to map[string]interface{}, lists to []interface{} and
+// whole numbers to int64
+func normalize(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			result[fmt.Sprint(key)] = normalize(element)
+		}
+		return result
+	case map[string]interface{}:
+		for key, element := range value {
+			value[key] = normalize(element)
+		}
+		return value
+	case []map[string]interface{}:
+		result := make([]interface{}, len(value))
+		for i, element := range value {
+			result[i] = normalize(element)
+		}
+		return result
+	case []interface{}:
+		for i, element := range value {
+			value[i] = normalize(element)
+		}
+		return value
+	case int:
+		return int64(value)
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return int64(value)
+		}
+	}
+	return value
+}
+
+// checkDocument reports the first field of the document which the type doesn't have and the first
+// value which can't be decoded into its field
+func checkDocument(value interface{}, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if value == nil || t.Kind() == reflect.Interface {
+		return nil
+	}
+	if t == durationType {
+		switch value := value.(type) {
+		case string:
+			if _, err := time.ParseDuration(value); err != nil {
+				return fmt.Errorf("%s: invalid duration %q, use e.g. 30s or 5m", describePath(path), value)
+			}
+			return nil
+		case int64, uint64:
+			// A bare number would be read as nanoseconds
+			return fmt.Errorf("%s: invalid duration %d, use e.g. 30s or 5m", describePath(path), value)
+		}
+		return typeError(value, "a duration", path)
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		mapping, ok := value.(map[string]interface{})
+		if !ok {
+			return typeError(value, "a mapping", path)
+		}
+		fields := yamlFields(t)
+		for _, key := range sortedKeys(mapping) {
+			field, found := fields[key]
+			if !found {
+				return fmt.Errorf("%s: unknown field %q", describePath(path), key)
+			}
+			if err := checkDocument(mapping[key], field.Type, joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		mapping, ok := value.(map[string]interface{})
+		if !ok {
+			return typeError(value, "a mapping", path)
+		}
+		for _, key := range sortedKeys(mapping) {
+			if err := checkDocument(mapping[key], t.Elem(), joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return typeError(value, "a list", path)
+		}
+		for i, element := range list {
+			if err := checkDocument(element, t.Elem(), path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		// Like YAML, every scalar can be used as string
+		switch value.(type) {
+		case string, int64, uint64, float64, bool:
+		default:
+			return typeError(value, "a string", path)
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return typeError(value, "a boolean", path)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := value.(uint64); ok {
+			return fmt.Errorf("%s: integer %d is too large", describePath(path), value)
+		}
+		if _, ok := value.(int64); !ok {
+			return typeError(value, "an integer", path)
+		}
+	case reflect.Float32, reflect.Float64:
+		switch value.(type) {
+		case int64, float64:
+		default:
+			return typeError(value, "a number", path)
+		}
+	}
+	return nil
+}
+
+// yamlFields returns the exported fields of the struct type by their YAML name
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func typeError(value interface{}, expected, path string) error {
+	var actual string
+	switch value.(type) {
+	case map[string]interface{}:
+		actual = "a mapping"
+	case []interface{}:
+		actual = "a list"
+	case string:
+		actual = "a string"
+	case bool:
+		actual = "a boolean"
+	case int64, uint64:
+		actual = "an integer"
+	case float64:
+		actual = "a number"
+	case time.Time:
+		actual = "a date"
+	default:
+		actual = fmt.Sprintf("%T", value)
+	}
+	return fmt.Errorf("%s: expected %s, got %s", describePath(path), expected, actual)
+}
+
+func sortedKeys(mapping map[string]interface{}) []string {
+	keys := make([]string, 0, len(mapping))
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "top level"
+	}
+	return path
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const configV2JSON = `{
+  "version": 2,
+  "server": {
+    "http_address": ":8443",
+    "data_dir": "/var/lib/kranen",
+    "listeners": [{"address": ":8443", "tls": true, "routes": ["webhooks"]}]
+  },
+  "tls": {
+    "cert": "/etc/kranen/cert.pem",
+    "key": "/etc/kranen/key.pem",
+    "cipher_suites": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"],
+    "hsts": "8760h"
+  },
+  "defaults": {"api_key": "foobaz", "tag": "latest"},
+  "hooks": [
+    {"name": "connctd/test", "script": "/deploy.sh"},
+    {"name": "connctd/other", "api_key": "other", "tag": "stable", "script": "/deploy-other.sh"}
+  ]
+}
+`
+
+const configV2TOML = `
+version = 2
+
+[server]
+http_address = ":8443"
+data_dir = "/var/lib/kranen"
+
+[[server.listeners]]
+address = ":8443"
+tls = true
+routes = ["webhooks"]
+
+[tls]
+cert = "/etc/kranen/cert.pem"
+key = "/etc/kranen/key.pem"
+cipher_suites = ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"]
+hsts = "8760h"
+
+[defaults]
+api_key = "foobaz"
+tag = "latest"
+
+[[hooks]]
+name = "connctd/test"
+script = "/deploy.sh"
+
+[[hooks]]
+name = "connctd/other"
+api_key = "other"
+tag = "stable"
+script = "/deploy-other.sh"
+`
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFormats(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-formats-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	expected, _, err := loadConfig(writeConfigFile(t, dir, "config.yml", configV2))
+	assert.Nil(err)
+	for name, content := range map[string]string{"config.json": configV2JSON, "config.toml": configV2TOML} {
+		config, version, err := loadConfig(writeConfigFile(t, dir, name, content))
+		assert.Nil(err, name)
+		assert.Equal(2, version, name)
+		assert.Equal(expected, config, name)
+	}
+
+	// A JSON list of hooks is a version 1 config
+	config, version, err := loadConfig(writeConfigFile(t, dir, "hooks.json", `[{"name": "connctd/test", "api_key": "foobaz", "script": "/deploy.sh"}]`))
+	assert.Nil(err)
+	assert.Equal(1, version)
+	assert.Equal([]RepoConfig{{Name: "connctd/test", ApiKey: "foobaz", Script: "/deploy.sh"}}, config.Hooks)
+}
+
+func TestStrictConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-formats-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		yaml, json, toml string
+		err              string
+	}{
+		{
+			"version: 2\nhooks:\n  - name: a\n    steps:\n      - scirpt: /deploy.sh\n",
+			`{"version": 2, "hooks": [{"name": "a", "steps": [{"scirpt": "/deploy.sh"}]}]}`,
+			"version = 2\n[[hooks]]\nname = \"a\"\n[[hooks.steps]]\nscirpt = \"/deploy.sh\"\n",
+			`hooks[0].steps[0]: unknown field "scirpt"`,
+		},
+		{
+			"version: 2\nsevrer:\n  data_dir: /tmp\n",
+			`{"version": 2, "sevrer": {"data_dir": "/tmp"}}`,
+			"version = 2\n[sevrer]\ndata_dir = \"/tmp\"\n",
+			`top level: unknown field "sevrer"`,
+		},
+		{
+			"version: 2\nhooks:\n  - name: a\n    retry:\n      max_attempts: three\n",
+			`{"version": 2, "hooks": [{"name": "a", "retry": {"max_attempts": "three"}}]}`,
+			"version = 2\n[[hooks]]\nname = \"a\"\n[hooks.retry]\nmax_attempts = \"three\"\n",
+			`hooks[0].retry.max_attempts: expected an integer, got a string`,
+		},
+		{
+			"version: 2\nhooks:\n  - name: a\n    debounce: 5 minutes\n",
+			`{"version": 2, "hooks": [{"name": "a", "debounce": "5 minutes"}]}`,
+			"version = 2\n[[hooks]]\nname = \"a\"\ndebounce = \"5 minutes\"\n",
+			`hooks[0].debounce: invalid duration "5 minutes", use e.g. 30s or 5m`,
+		},
+		{
+			"version: 2\nhooks:\n  - name: a\n    timeout: 30\n",
+			`{"version": 2, "hooks": [{"name": "a", "timeout": 30}]}`,
+			"version = 2\n[[hooks]]\nname = \"a\"\ntimeout = 30\n",
+			`hooks[0].timeout: invalid duration 30, use e.g. 30s or 5m`,
+		},
+		{
+			"version: 2\nhooks:\n  name: a\n",
+			`{"version": 2, "hooks": {"name": "a"}}`,
+			"version = 2\n[hooks]\nname = \"a\"\n",
+			`hooks: expected a list, got a mapping`,
+		},
+	}
+	for _, c := range cases {
+		for name, content := range map[string]string{"config.yml": c.yaml, "config.json": c.json, "config.toml": c.toml} {
+			_, _, err := loadConfig(writeConfigFile(t, dir, name, content))
+			if assert.NotNil(err, name) {
+				assert.Equal(c.err, err.Error(), name)
+			}
+		}
+	}
+
+	// Syntax errors report their line in every format
+	_, _, err = loadConfig(writeConfigFile(t, dir, "config.json", "{\n  \"version\": 2,\n  \"hooks\": [}\n}"))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "line 3, column 13")
+	}
+	_, _, err = loadConfig(writeConfigFile(t, dir, "config.toml", "version = 2\n[[hooks]]\nname = \n"))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "line 3")
+	}
+	_, _, err = loadConfig(writeConfigFile(t, dir, "config.yml", "version: 2\nhooks:\n  - name: a\n    script: [b\n"))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "yaml: line")
+	}
+}
+
+func TestYAMLScalars(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-formats-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// Unquoted scalars keep their text in string fields
+	content := "version: 2\nhooks:\n" +
+		"  - {name: a, tag: 1.0, api_key: 0123, script: /a.sh}\n" +
+		"  - {name: b, tag: 1.10, api_key: 18446744073709551615, script: /b.sh}\n"
+	config, _, err := loadConfig(writeConfigFile(t, dir, "config.yml", content))
+	assert.Nil(err)
+	if assert.Equal(2, len(config.Hooks)) {
+		assert.Equal("1.0", config.Hooks[0].Tag)
+		assert.Equal("0123", config.Hooks[0].ApiKey)
+		assert.Equal("1.10", config.Hooks[1].Tag)
+		assert.Equal("18446744073709551615", config.Hooks[1].ApiKey)
+	}
+	hooks, err := loadHookFile(writeConfigFile(t, dir, "hooks.yml", "- {name: a, tag: 1.0, script: /a.sh}\n"))
+	assert.Nil(err)
+	if assert.Equal(1, len(hooks.Hooks)) {
+		assert.Equal("1.0", hooks.Hooks[0].Tag)
+	}
+
+	_, _, err = loadConfig(writeConfigFile(t, dir, "config.yml", "version: 2\nhooks:\n  - {name: a, retry: {max_attempts: 18446744073709551615}}\n"))
+	if assert.NotNil(err) {
+		assert.Equal("hooks[0].retry.max_attempts: integer 18446744073709551615 is too large", err.Error())
+	}
+}
+
+func TestConfigDirFormats(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-formats-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	writeConfigFile(t, dir, "a.json", `{"hooks": [{"name": "a", "api_key": "key", "script": "/a.sh"}]}`)
+	writeConfigFile(t, dir, "b.toml", "[[hooks]]\nname = \"b\"\napi_key = \"key\"\nscript = \"/b.sh\"\n")
+	writeConfigFile(t, dir, "c.yml", "- name: c\n  api_key: key\n  script: /c.sh\n")
+	writeConfigFile(t, dir, "d.txt", "not a config")
+	config, err := loadConfigFiles("", dir)
+	assert.Nil(err)
+	assert.Nil(config.validate())
+	if assert.Equal(3, len(config.Hooks)) {
+		assert.Equal("a", config.Hooks[0].Name)
+		assert.Equal("b", config.Hooks[1].Name)
+		assert.Equal("c", config.Hooks[2].Name)
+		assert.Equal(filepath.Join(dir, "b.toml"), config.source(1))
+	}
+}
+
+func TestEncodeConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-formats-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	expected, _, err := loadConfig(writeConfigFile(t, dir, "config.yml", configV2))
+	assert.Nil(err)
+	for _, name := range []string{"encoded.yml", "encoded.json", "encoded.toml"} {
+		content, err := encodeConfig(name, expected)
+		assert.Nil(err, name)
+		config, _, err := loadConfig(writeConfigFile(t, dir, name, string(content)))
+		assert.Nil(err, name)
+		assert.Equal(expected, config, name)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	signatureHeader       = "X-Kranen-Signature"
+	defaultForwardTimeout = 10 * time.Second
+)
+
+var forwardBackoff = time.Second
+
+// ForwardRequest is a rendered forward action ready to be sent
+type ForwardRequest struct {
+	Config ForwardConfig
+	Body   []byte
+}
+
+func newForwardRequest(config ForwardConfig, data tplData, rawPayload []byte) (ForwardRequest, error) {
+	req := ForwardRequest{
+		Config: config,
+		Body:   rawPayload,
+	}
+	if config.Body != "" {
+		body, err := renderTemplate("forward", config.Body, data)
+		if err != nil {
+			return req, err
+		}
+		req.Body = []byte(body)
+	}
+	return req, nil
+}
+
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send posts the body to all configured URLs and returns the first error encountered.
+// Every URL is tried even if a previous one failed.
+func (f ForwardRequest) Send(ctx context.Context) error {
+	timeout := f.Config.Timeout
+	if timeout == 0 {
+		timeout = defaultForwardTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var firstErr error
+	for _, url := range f.Config.URLs {
+		err := f.sendWithRetries(ctx, client, url)
+		if err != nil {
+			loggerFrom(ctx).Warn("Failed to forward event", "url", url, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (f ForwardRequest) sendWithRetries(ctx context.Context, client *http.Client, url string) error {
+	var err error
+	for attempt := 0; attempt <= f.Config.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * forwardBackoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err = f.send(ctx, client, url)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (f ForwardRequest) send(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(f.Body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range f.Config.Headers {
+		req.Header.Set(key, value)
+	}
+	if f.Config.Secret != "" {
+		req.Header.Set(signatureHeader, signBody(f.Config.Secret, f.Body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Downstream responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForwardOriginalPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	var receivedBody []byte
+	var receivedHeader http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		receivedHeader = r.Header
+	}))
+	defer server.Close()
+
+	config := ForwardConfig{
+		URLs:    []string{server.URL},
+		Headers: map[string]string{"X-Team": "ops"},
+		Secret:  "s3cr3t",
+	}
+	forward, err := newForwardRequest(config, tplData{}, []byte(successPayload))
+	assert.Nil(err)
+	assert.Nil(forward.Send(context.Background()))
+
+	assert.Equal(successPayload, string(receivedBody))
+	assert.Equal("ops", receivedHeader.Get("X-Team"))
+	assert.Equal("application/json", receivedHeader.Get("Content-Type"))
+	assert.Equal(signBody("s3cr3t", []byte(successPayload)), receivedHeader.Get(signatureHeader))
+}
+
+func TestForwardTemplatedBody(t *testing.T) {
+	assert := assert.New(t)
+
+	var receivedBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		_, hasSignature := r.Header[signatureHeader]
+		assert.False(hasSignature)
+	}))
+	defer server.Close()
+
+	var payload Payload
+	assert.Nil(json.Unmarshal([]byte(successPayload), &payload))
+
+	config := ForwardConfig{
+		URLs: []string{server.URL},
+		Body: `{"image":"{{.Hub.Repo.RepoName}}:{{.Hub.PushData.Tag}}"}`,
+	}
+	forward, err := newForwardRequest(config, tplData{Hub: payload}, []byte(successPayload))
+	assert.Nil(err)
+	assert.Nil(forward.Send(context.Background()))
+	assert.Equal(`{"image":"connctd/test:latest"}`, string(receivedBody))
+}
+
+func TestForwardRetries(t *testing.T) {
+	assert := assert.New(t)
+	forwardBackoff = time.Millisecond
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	forward := ForwardRequest{Config: ForwardConfig{URLs: []string{server.URL}, Retries: 1}}
+	assert.NotNil(forward.Send(context.Background()))
+	assert.Equal(2, calls)
+
+	calls = 0
+	forward.Config.Retries = 2
+	assert.Nil(forward.Send(context.Background()))
+	assert.Equal(3, calls)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultGitOpsBranch  = "master"
+	defaultGitOpsRetries = 3
+	defaultGitOpsMessage = "Update {{.Hub.Repo.RepoName}} to {{.Hub.PushData.Tag}}"
+)
+
+var keySegmentRegexp = regexp.MustCompile(`^([^\[\]]*)(?:\[([^\]]+)\])?$`)
+
+// GitOpsRequest is a rendered gitops action ready to be applied
+type GitOpsRequest struct {
+	Config  GitOpsConfig
+	Message string
+	// Values maps file paths to the keys to update in these files
+	Values map[string]map[string]string
+}
+
+func newGitOpsRequest(config GitOpsConfig, data tplData) (*GitOpsRequest, error) {
+	messageTemplate := config.Message
+	if messageTemplate == "" {
+		messageTemplate = defaultGitOpsMessage
+	}
+	message, err := renderTemplate("gitops message", messageTemplate, data)
+	if err != nil {
+		return nil, err
+	}
+	req := &GitOpsRequest{
+		Config:  config,
+		Message: message,
+		Values:  make(map[string]map[string]string),
+	}
+	for _, file := range config.Files {
+		values := make(map[string]string)
+		for key, valueTemplate := range file.Set {
+			value, err := renderTemplate("gitops value", valueTemplate, data)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		}
+		req.Values[file.Path] = values
+	}
+	return req, nil
+}
+
+func (g *GitOpsRequest) branch() string {
+	if g.Config.Branch == "" {
+		return defaultGitOpsBranch
+	}
+	return g.Config.Branch
+}
+
+func (g *GitOpsRequest) workdir() string {
+	if g.Config.Workdir != "" {
+		return g.Config.Workdir
+	}
+	hash := sha256.Sum256([]byte(g.Config.Repository + "#" + g.branch()))
+	return filepath.Join(os.TempDir(), "kranen-gitops", hex.EncodeToString(hash[:6]))
+}
+
+// Apply updates the configured files in the repository, commits and pushes the change.
+// If the push is rejected because the remote changed in the meantime the update is
+// reapplied on top of the new remote state.
+func (g *GitOpsRequest) Apply(ctx context.Context) error {
+	retries := g.Config.Retries
+	if retries == 0 {
+		retries = defaultGitOpsRetries
+	}
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err = g.checkout(ctx); err != nil {
+			return err
+		}
+		var changed bool
+		if changed, err = g.commit(ctx); err != nil {
+			return err
+		}
+		if !changed {
+			loggerFrom(ctx).Info("Repository is already up to date", "repository", g.Config.Repository)
+			return nil
+		}
+		if err = g.git(ctx, "push", "origin", "HEAD:"+g.branch()); err == nil {
+			return nil
+		}
+		loggerFrom(ctx).Warn("Push failed, retrying", "repository", g.Config.Repository, "error", err)
+	}
+	return err
+}
+
+func (g *GitOpsRequest) checkout(ctx context.Context) error {
+	workdir := g.workdir()
+	if _, err := os.Stat(filepath.Join(workdir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(workdir), 0700); err != nil {
+			return err
+		}
+		return g.run(ctx, "", "clone", "--branch", g.branch(), g.Config.Repository, workdir)
+	}
+	if err := g.git(ctx, "fetch", "origin", g.branch()); err != nil {
+		return err
+	}
+	return g.git(ctx, "reset", "--hard", "origin/"+g.branch())
+}
+
+func (g *GitOpsRequest) commit(ctx context.Context) (bool, error) {
+	paths := make([]string, 0, len(g.Values))
+	for path := range g.Values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := updateYAMLFile(filepath.Join(g.workdir(), path), g.Values[path]); err != nil {
+			return false, fmt.Errorf("Can't update %s: %+v", path, err)
+		}
+	}
+	if err := g.git(ctx, append([]string{"add", "--"}, paths...)...); err != nil {
+		return false, err
+	}
+	if err := g.git(ctx, "diff", "--cached", "--quiet"); err == nil {
+		return false, nil
+	}
+	authorName := g.Config.AuthorName
+	if authorName == "" {
+		authorName = "kranen"
+	}
+	authorEmail := g.Config.AuthorEmail
+	if authorEmail == "" {
+		authorEmail = "kranen@localhost"
+	}
+	err := g.git(ctx, "-c", "user.name="+authorName, "-c", "user.email="+authorEmail, "commit", "-m", g.Message)
+	return err == nil, err
+}
+
+func (g *GitOpsRequest) git(ctx context.Context, args ...string) error {
+	return g.run(ctx, g.workdir(), args...)
+}
+
+func (g *GitOpsRequest) run(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	if g.Config.SSHKey != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes", g.Config.SSHKey))
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s failed: %+v: %s", args[0], err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// yamlEdit replaces the bytes from start to end of a file with text
+type yamlEdit struct {
+	start, end int
+	text       string
+}
+
+// updateYAMLFile sets the values in the file. Only the text of the replaced values changes, so
+// comments, formatting and all documents of a multi-document file are kept. A key is set in every
+// document which contains it and must be found in at least one.
+func updateYAMLFile(path string, values map[string]string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var documents []*yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		document := new(yaml.Node)
+		if err := decoder.Decode(document); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		documents = append(documents, document)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var edits []yamlEdit
+	for _, key := range keys {
+		var notFound error = fmt.Errorf("Key %s not found in %s", key, path)
+		found := false
+		for i, document := range documents {
+			node, flow, err := findYAMLValue(document, key)
+			if err != nil {
+				if i == 0 {
+					notFound = err
+				}
+				continue
+			}
+			edit, err := replaceScalar(content, node, flow, values[key])
+			if err != nil {
+				return fmt.Errorf("Can't set %s: %+v", key, err)
+			}
+			edits = append(edits, edit)
+			found = true
+		}
+		if !found {
+			return notFound
+		}
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	for i := 1; i < len(edits); i++ {
+		if edits[i].start < edits[i-1].end {
+			return fmt.Errorf("Two keys refer to the same value in %s", path)
+		}
+	}
+	for i := len(edits) - 1; i >= 0; i-- {
+		edit := edits[i]
+		content = append(content[:edit.start:edit.start], append([]byte(edit.text), content[edit.end:]...)...)
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// findYAMLValue returns the scalar at the given key path and whether it is part of a flow
+// collection. The path consists of dot separated map keys, each optionally followed by a list
+// index ("containers[0]") or a selector matching a list element by one of its fields
+// ("images[name=connctd/test]").
+func findYAMLValue(document *yaml.Node, keyPath string) (*yaml.Node, bool, error) {
+	current := document
+	if current.Kind == yaml.DocumentNode && len(current.Content) > 0 {
+		current = current.Content[0]
+	}
+	flow := false
+	for _, segment := range strings.Split(keyPath, ".") {
+		match := keySegmentRegexp.FindStringSubmatch(segment)
+		if match == nil {
+			return nil, false, fmt.Errorf("Invalid key segment %s in %s", segment, keyPath)
+		}
+		current = resolveAlias(current)
+		if current.Kind != yaml.MappingNode {
+			return nil, false, fmt.Errorf("%s is not a mapping in %s", segment, keyPath)
+		}
+		flow = current.Style&yaml.FlowStyle != 0
+		var value *yaml.Node
+		for j := 0; j+1 < len(current.Content); j += 2 {
+			if current.Content[j].Value == match[1] {
+				value = current.Content[j+1]
+				break
+			}
+		}
+		if value == nil {
+			return nil, false, fmt.Errorf("Key %s not found in %s", match[1], keyPath)
+		}
+		current = value
+		if match[2] == "" {
+			continue
+		}
+		list := resolveAlias(current)
+		if list.Kind != yaml.SequenceNode {
+			return nil, false, fmt.Errorf("%s is not a list in %s", match[1], keyPath)
+		}
+		element, err := selectListElement(list.Content, match[2])
+		if err != nil {
+			return nil, false, fmt.Errorf("%+v in %s", err, keyPath)
+		}
+		flow = list.Style&yaml.FlowStyle != 0
+		current = list.Content[element]
+	}
+	if current.Kind != yaml.ScalarNode {
+		return nil, false, fmt.Errorf("%s is not a single value", keyPath)
+	}
+	return current, flow, nil
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func selectListElement(list []*yaml.Node, selector string) (int, error) {
+	if index, err := strconv.Atoi(selector); err == nil {
+		if index < 0 || index >= len(list) {
+			return 0, fmt.Errorf("Index %d out of range", index)
+		}
+		return index, nil
+	}
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid selector %s", selector)
+	}
+	for i, element := range list {
+		mapping := resolveAlias(element)
+		if mapping.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(mapping.Content); j += 2 {
+			if mapping.Content[j].Value == parts[0] && mapping.Content[j+1].Value == parts[1] {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("No element matches %s", selector)
+}
+
+// replaceScalar returns the edit replacing the text of the scalar with the value. The value keeps
+// the quoting style of the scalar if possible.
+func replaceScalar(content []byte, node *yaml.Node, flow bool, value string) (yamlEdit, error) {
+	start := yamlOffset(content, node.Line, node.Column)
+	edit := yamlEdit{start: start}
+	switch {
+	case node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		return edit, fmt.Errorf("block scalars in line %d can't be replaced", node.Line)
+	case node.Style&yaml.DoubleQuotedStyle != 0:
+		edit.end = quotedEnd(content, start, '"')
+		edit.text = strconv.Quote(value)
+	case node.Style&yaml.SingleQuotedStyle != 0:
+		edit.end = quotedEnd(content, start, '\'')
+		edit.text = "'" + strings.Replace(value, "'", "''", -1) + "'"
+		if strings.ContainsAny(value, "\n\r") {
+			edit.text = strconv.Quote(value)
+		}
+	default:
+		edit.end = start + len(node.Value)
+		if edit.end > len(content) || string(content[start:edit.end]) != node.Value {
+			return edit, fmt.Errorf("the value in line %d spans several lines or has a tag", node.Line)
+		}
+		edit.text = plainScalar(value, flow)
+	}
+	if edit.end < 0 {
+		return edit, fmt.Errorf("the value in line %d has a tag or anchor", node.Line)
+	}
+	return edit, nil
+}
+
+// yamlOffset converts a line and column, both counted from 1 and the column in characters, to a
+// byte offset
+func yamlOffset(content []byte, line, column int) int {
+	offset := 0
+	for ; line > 1 && offset < len(content); offset++ {
+		if content[offset] == '\n' {
+			line--
+		}
+	}
+	for ; column > 1 && offset < len(content); column-- {
+		_, size := utf8.DecodeRune(content[offset:])
+		offset += size
+	}
+	return offset
+}
+
+// quotedEnd returns the offset following the quoted scalar starting at start or -1 if there is
+// no quote at start
+func quotedEnd(content []byte, start int, quote byte) int {
+	if start >= len(content) || content[start] != quote {
+		return -1
+	}
+	for i := start + 1; i < len(content); i++ {
+		switch {
+		case quote == '"' && content[i] == '\\':
+			i++
+		case content[i] == quote && quote == '\'' && i+1 < len(content) && content[i+1] == '\'':
+			i++
+		case content[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// plainScalar returns the value unquoted unless it would be read as something else than this string
+func plainScalar(value string, flow bool) string {
+	encoded, err := yaml.Marshal(value)
+	text := strings.TrimSuffix(string(encoded), "\n")
+	if err != nil || strings.Contains(text, "\n") || (flow && strings.ContainsAny(text, ",[]{}")) {
+		return strconv.Quote(value)
+	}
+	return text
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	valuesFile = `image:
+  repository: connctd/test
+  tag: v1
+replicas: 2
+`
+	kustomizationFile = `resources:
+- deployment.yaml
+images:
+- name: connctd/other
+  newTag: v3
+- name: connctd/test
+  newTag: v1
+`
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@localhost",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@localhost")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %v: %s", args, err, output)
+	}
+	return string(output)
+}
+
+// prepareBareRepository creates a bare repository containing a helm values file and a kustomization
+func prepareBareRepository(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kranen-gitops-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := filepath.Join(dir, "remote.git")
+	seed := filepath.Join(dir, "seed")
+	runGit(t, dir, "init", "--bare", "--initial-branch=master", bare)
+	runGit(t, dir, "clone", bare, seed)
+	ioutil.WriteFile(filepath.Join(seed, "values.yaml"), []byte(valuesFile), 0644)
+	ioutil.WriteFile(filepath.Join(seed, "kustomization.yaml"), []byte(kustomizationFile), 0644)
+	runGit(t, seed, "add", ".")
+	runGit(t, seed, "commit", "-m", "Initial commit")
+	runGit(t, seed, "push", "origin", "HEAD:master")
+	return dir
+}
+
+func gitOpsTestRequest(dir string) *GitOpsRequest {
+	return &GitOpsRequest{
+		Config: GitOpsConfig{
+			Repository: filepath.Join(dir, "remote.git"),
+			Workdir:    filepath.Join(dir, "work"),
+		},
+		Message: "Deploy connctd/test:v2",
+		Values: map[string]map[string]string{
+			"values.yaml":        {"image.tag": "v2"},
+			"kustomization.yaml": {"images[name=connctd/test].newTag": "v2"},
+		},
+	}
+}
+
+func TestGitOpsApply(t *testing.T) {
+	assert := assert.New(t)
+	dir := prepareBareRepository(t)
+	defer os.RemoveAll(dir)
+	bare := filepath.Join(dir, "remote.git")
+
+	req := gitOpsTestRequest(dir)
+	assert.Nil(req.Apply(context.Background()))
+
+	assert.Equal("Deploy connctd/test:v2\n", runGit(t, bare, "log", "-1", "--format=%s", "master"))
+	assert.Contains(runGit(t, bare, "show", "master:values.yaml"), "tag: v2")
+	kustomization := runGit(t, bare, "show", "master:kustomization.yaml")
+	assert.Contains(kustomization, "- name: connctd/test\n  newTag: v2")
+	assert.Contains(kustomization, "- name: connctd/other\n  newTag: v3")
+
+	// Applying the same values again must not create an empty commit
+	assert.Nil(req.Apply(context.Background()))
+	assert.Equal("2\n", runGit(t, bare, "rev-list", "--count", "master"))
+}
+
+func TestGitOpsRetryOnRejectedPush(t *testing.T) {
+	assert := assert.New(t)
+	dir := prepareBareRepository(t)
+	defer os.RemoveAll(dir)
+	bare := filepath.Join(dir, "remote.git")
+
+	// Reject the first push as if someone else pushed in the meantime
+	marker := filepath.Join(dir, "reject")
+	ioutil.WriteFile(marker, nil, 0644)
+	hook := "#!/bin/sh\nif [ -e " + marker + " ]; then rm " + marker + "; exit 1; fi\n"
+	assert.Nil(ioutil.WriteFile(filepath.Join(bare, "hooks", "pre-receive"), []byte(hook), 0755))
+
+	req := gitOpsTestRequest(dir)
+	req.Config.Retries = 1
+	assert.Nil(req.Apply(context.Background()))
+	_, err := os.Stat(marker)
+	assert.True(os.IsNotExist(err))
+	assert.Contains(runGit(t, bare, "show", "master:values.yaml"), "tag: v2")
+}
+
+const manifestsFile = `# Deployment of the test service
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test # keep in sync with the service
+spec:
+  template:
+    spec:
+      containers:
+        - name: test
+          image: "connctd/test:v1" # set by kranen
+          args: [--port, '8080']
+---
+# Service of the test service
+apiVersion: v1
+kind: Service
+metadata:
+  name: test
+  labels: {image: connctd/test:v1}
+`
+
+func TestUpdateYAMLFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-gitops-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "manifests.yaml")
+	ioutil.WriteFile(path, []byte(manifestsFile), 0644)
+
+	// Comments, quoting and the second document are kept
+	assert.Nil(updateYAMLFile(path, map[string]string{
+		"spec.template.spec.containers[name=test].image": "connctd/test:v2",
+		"spec.template.spec.containers[0].args[1]":       "it's 9090",
+		"metadata.labels.image":                          "connctd/test:v2, latest",
+	}))
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	expected := strings.Replace(manifestsFile, `"connctd/test:v1"`, `"connctd/test:v2"`, 1)
+	expected = strings.Replace(expected, `'8080'`, `'it''s 9090'`, 1)
+	expected = strings.Replace(expected, `{image: connctd/test:v1}`, `{image: "connctd/test:v2, latest"}`, 1)
+	assert.Equal(expected, string(content))
+
+	// A key is set in every document containing it
+	assert.Nil(updateYAMLFile(path, map[string]string{"metadata.name": "other"}))
+	content, _ = ioutil.ReadFile(path)
+	assert.Equal(2, strings.Count(string(content), "name: other"))
+	assert.Contains(string(content), "name: other # keep in sync with the service")
+}
+
+func TestUpdateYAMLFileErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-gitops-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kustomization.yaml")
+	ioutil.WriteFile(path, []byte(kustomizationFile+"description: |\n  multiple\n  lines\n"), 0644)
+
+	for _, key := range []string{"images[name=connctd/missing].newTag", "images[5].newTag", "resources.foo", "missing", "images", "description"} {
+		assert.NotNil(updateYAMLFile(path, map[string]string{key: "v2"}), key)
+	}
+	content, _ := ioutil.ReadFile(path)
+	assert.Contains(string(content), kustomizationFile)
+	assert.Nil(updateYAMLFile(path, map[string]string{"images[0].newTag": "v4"}))
+	content, _ = ioutil.ReadFile(path)
+	assert.Contains(string(content), "- name: connctd/other\n  newTag: v4\n")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var (
+	configLoaded      atomic.Bool
+	executorAccepting atomic.Bool
+)
+
+// VersionInfo describes the running binary
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// ReadinessReport lists the result of every readiness check
+type ReadinessReport struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+func registerHealthRoutes(router *httprouter.Router) {
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", readyz)
+	router.GET("/version", versionHandler)
+}
+
+func healthz(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+func readyz(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	report := readiness(*readyQueueThreshold)
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func readiness(queueThreshold int) ReadinessReport {
+	report := ReadinessReport{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			report.Ready = false
+			report.Checks[name] = err.Error()
+			return
+		}
+		report.Checks[name] = "ok"
+	}
+	if !configLoaded.Load() {
+		check("config", fmt.Errorf("config not loaded"))
+	} else {
+		check("config", nil)
+	}
+	if !executorAccepting.Load() {
+		check("executor", fmt.Errorf("executor not accepting work"))
+	} else {
+		check("executor", nil)
+	}
+	if depth := int(queueDepth.Value()); depth >= queueThreshold {
+		check("queue", fmt.Errorf("%d jobs queued, threshold is %d", depth, queueThreshold))
+	} else {
+		check("queue", nil)
+	}
+	check("store", state.checkWritable())
+	return report
+}
+
+func buildInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	writeJSON(w, http.StatusOK, buildInfo())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous *stateStore) { state = previous }(state)
+	defer configLoaded.Store(configLoaded.Load())
+	defer executorAccepting.Store(executorAccepting.Load())
+
+	dir, err := ioutil.TempDir("", "kranen-health-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	state, err = loadStateStore(dir)
+	assert.Nil(err)
+
+	configLoaded.Store(false)
+	executorAccepting.Store(true)
+	report := readiness(10)
+	assert.False(report.Ready)
+	assert.Equal("config not loaded", report.Checks["config"])
+	assert.Equal("ok", report.Checks["executor"])
+	assert.Equal("ok", report.Checks["store"])
+
+	configLoaded.Store(true)
+	report = readiness(10)
+	assert.True(report.Ready)
+
+	report = readiness(0)
+	assert.False(report.Ready)
+	assert.Contains(report.Checks["queue"], "threshold is 0")
+
+	os.RemoveAll(dir)
+	report = readiness(10)
+	assert.False(report.Ready)
+	assert.NotEqual("ok", report.Checks["store"])
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	defer executorAccepting.Store(executorAccepting.Load())
+	router := httprouter.New()
+	registerHealthRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	executorAccepting.Store(false)
+	resp, err = http.Get(server.URL + "/readyz")
+	assert.Nil(err)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	var report ReadinessReport
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal("executor not accepting work", report.Checks["executor"])
+
+	resp, err = http.Get(server.URL + "/version")
+	assert.Nil(err)
+	var info VersionInfo
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal("dev", info.Version)
+	assert.NotEmpty(info.GoVersion)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistorySize = 100
+	// maxRunLogLines is the number of output lines kept per run
+	maxRunLogLines = 1000
+)
+
+const (
+	TriggerWebhook  = "webhook"
+	TriggerRollback = "rollback"
+	TriggerManual   = "manual"
+)
+
+type RunStatus string
+
+const (
+	StatusQueued    RunStatus = "queued"
+	StatusRunning   RunStatus = "running"
+	StatusSucceeded RunStatus = "succeeded"
+	StatusFailed    RunStatus = "failed"
+	StatusSkipped   RunStatus = "skipped"
+	// StatusInterrupted marks runs stopped or never started because kranen shut down
+	StatusInterrupted RunStatus = "interrupted"
+	// StatusDiscarded marks runs which waited longer than -queueMaxAge and were never started
+	StatusDiscarded RunStatus = "discarded"
+	// StatusRetrying marks runs waiting for their next attempt
+	StatusRetrying RunStatus = "retrying"
+	// StatusSuperseded marks runs replaced by a later event within the hook's debounce window
+	StatusSuperseded RunStatus = "superseded"
+)
+
+// Final reports whether a run with this status won't change anymore
+func (s RunStatus) Final() bool {
+	switch s {
+	case StatusSucceeded, StatusFailed, StatusInterrupted, StatusDiscarded, StatusSuperseded:
+		return true
+	}
+	return false
+}
+
+// Run is one execution of a hook's pipeline
+type Run struct {
+	ID      string `json:"id"`
+	Hook    string `json:"hook"`
+	Repo    string `json:"repo"`
+	Tag     string `json:"tag"`
+	Trigger string `json:"trigger"`
+	// User is the admin user who requested a manual run
+	User string `json:"user,omitempty"`
+	// RequestID is the ID of the HTTP request which caused the run
+	RequestID string    `json:"request_id,omitempty"`
+	Status    RunStatus `json:"status"`
+	// SupersededBy is the ID of the run which replaced this one
+	SupersededBy string    `json:"superseded_by,omitempty"`
+	Queued       time.Time `json:"queued"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	// Steps are the results of the latest attempt
+	Steps    []*StepResult `json:"steps"`
+	Attempts []*Attempt    `json:"attempts,omitempty"`
+
+	log []LogLine
+	// logDropped counts the lines removed from the start of the log
+	logDropped int
+}
+
+// LogLine is a line written by one of the run's scripts or an error of one of its steps
+type LogLine struct {
+	Time time.Time `json:"time"`
+	Step string    `json:"step"`
+	// Stream is stdout, stderr or error
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// Attempt is one execution of the pipeline's steps, runs have several if they are retried
+type Attempt struct {
+	Number   int           `json:"number"`
+	Status   RunStatus     `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Steps    []*StepResult `json:"steps"`
+}
+
+// StepResult is the outcome of a single pipeline step
+type StepResult struct {
+	Name     string            `json:"name"`
+	Status   RunStatus         `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	Stdout   string            `json:"stdout"`
+	Outputs  map[string]string `json:"outputs,omitempty"`
+}
+
+func (r *Run) copy() Run {
+	result := *r
+	result.Steps = copySteps(r.Steps)
+	result.log = nil
+	if r.Attempts != nil {
+		result.Attempts = make([]*Attempt, len(r.Attempts))
+		for i, attempt := range r.Attempts {
+			attemptCopy := *attempt
+			attemptCopy.Steps = copySteps(attempt.Steps)
+			result.Attempts[i] = &attemptCopy
+		}
+	}
+	return result
+}
+
+func copySteps(steps []*StepResult) []*StepResult {
+	result := make([]*StepResult, len(steps))
+	for i, step := range steps {
+		stepCopy := *step
+		result[i] = &stepCopy
+	}
+	return result
+}
+
+// runHistory keeps the most recent runs in memory
+type runHistory struct {
+	sync.Mutex
+	runs []*Run
+	max  int
+	// changed is closed and replaced whenever a run or its log changes
+	changed chan struct{}
+}
+
+var history = newRunHistory(defaultHistorySize)
+
+func newRunHistory(max int) *runHistory {
+	return &runHistory{max: max, changed: make(chan struct{})}
+}
+
+// broadcast wakes up everyone watching runs, it must be called with the lock held
+func (h *runHistory) broadcast() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func newRunID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (h *runHistory) add(run *Run) {
+	h.Lock()
+	defer h.Unlock()
+	h.runs = append(h.runs, run)
+	if len(h.runs) > h.max {
+		h.runs = h.runs[len(h.runs)-h.max:]
+	}
+}
+
+// update modifies a run while holding the history lock so readers get consistent copies
+func (h *runHistory) update(run *Run, f func(run *Run)) {
+	h.Lock()
+	defer h.Unlock()
+	f(run)
+	h.broadcast()
+}
+
+// List returns copies of all runs, most recent first
+func (h *runHistory) List() []Run {
+	h.Lock()
+	defer h.Unlock()
+	result := make([]Run, 0, len(h.runs))
+	for i := len(h.runs) - 1; i >= 0; i-- {
+		result = append(result, h.runs[i].copy())
+	}
+	return result
+}
+
+// Get returns a copy of the run with the given ID
+func (h *runHistory) Get(id string) (Run, bool) {
+	h.Lock()
+	defer h.Unlock()
+	for _, run := range h.runs {
+		if run.ID == id {
+			return run.copy(), true
+		}
+	}
+	return Run{}, false
+}
+
+// appendLog adds a line to the log of the run, only the last maxRunLogLines are kept
+func (h *runHistory) appendLog(run *Run, line LogLine) {
+	h.Lock()
+	defer h.Unlock()
+	run.log = append(run.log, line)
+	if len(run.log) > maxRunLogLines {
+		run.log = run.log[1:]
+		run.logDropped++
+	}
+	h.broadcast()
+}
+
+// Watch returns the run, the lines of its log starting with line number next (or the oldest
+// line still kept) and the number of the line following them. The returned channel is closed
+// as soon as the run or its log changes.
+func (h *runHistory) Watch(id string, next int) (Run, []LogLine, int, <-chan struct{}, bool) {
+	h.Lock()
+	defer h.Unlock()
+	for _, run := range h.runs {
+		if run.ID != id {
+			continue
+		}
+		start := next - run.logDropped
+		if start < 0 {
+			start = 0
+		}
+		if start > len(run.log) {
+			start = len(run.log)
+		}
+		lines := append([]LogLine(nil), run.log[start:]...)
+		return run.copy(), lines, run.logDropped + len(run.log), h.changed, true
+	}
+	return Run{}, nil, next, h.changed, false
+}
+
+// Log returns a copy of the log of the run with the given ID
+func (h *runHistory) Log(id string) ([]LogLine, bool) {
+	h.Lock()
+	defer h.Unlock()
+	for _, run := range h.runs {
+		if run.ID == id {
+			return append([]LogLine(nil), run.log...), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	RoutesWebhooks = "webhooks"
+	RoutesAdmin    = "admin"
+	RoutesMetrics  = "metrics"
+	RoutesHealth   = "health"
+
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd:"
+)
+
+var allRoutes = []string{RoutesWebhooks, RoutesAdmin, RoutesMetrics, RoutesHealth}
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+var listenFDsStart = 3
+
+// ListenerConfig describes an address kranen accepts requests on
+type ListenerConfig struct {
+	// Address is host:port, unix:<path> for a unix socket or systemd:<name> for a socket passed by
+	// systemd, where name is the FileDescriptorName of the socket or its index
+	Address string `yaml:"address,omitempty"`
+	// TLS serves HTTPS with the certificate given by -cert and -key, -tls or -acmeDomains
+	TLS bool `yaml:"tls,omitempty"`
+	// Routes are the route groups served: webhooks, admin, metrics and health. All if empty.
+	Routes []string `yaml:"routes,omitempty"`
+	// Mode sets the permissions of a unix socket, e.g. "0660"
+	Mode string `yaml:"mode,omitempty"`
+}
+
+func loadListeners(path string) ([]ListenerConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []ListenerConfig
+	if err := yaml.Unmarshal(content, &listeners); err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("%s contains no listeners", path)
+	}
+	for _, listener := range listeners {
+		if err := listener.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return listeners, nil
+}
+
+func (l ListenerConfig) validate() error {
+	if l.Address == "" {
+		return fmt.Errorf("Listener needs an address")
+	}
+	for _, routes := range l.Routes {
+		if !contains(allRoutes, routes) {
+			return fmt.Errorf("Listener %s: unknown routes %q, use %s", l.Address, routes, strings.Join(allRoutes, ", "))
+		}
+	}
+	if l.Mode != "" {
+		if !strings.HasPrefix(l.Address, unixPrefix) {
+			return fmt.Errorf("Listener %s: mode is only supported for unix sockets", l.Address)
+		}
+		if _, err := strconv.ParseUint(l.Mode, 8, 32); err != nil {
+			return fmt.Errorf("Listener %s: invalid mode %q", l.Address, l.Mode)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultListeners returns the listeners given by -httpAddress and -adminAddress
+func defaultListeners(tls bool) []ListenerConfig {
+	if *adminAddress == "" {
+		return []ListenerConfig{{Address: *httpAddress, TLS: tls}}
+	}
+	return []ListenerConfig{
+		{Address: *httpAddress, TLS: tls, Routes: []string{RoutesWebhooks}},
+		{Address: *adminAddress, Routes: []string{RoutesAdmin, RoutesMetrics, RoutesHealth}},
+	}
+}
+
+func (l ListenerConfig) serves(routes string) bool {
+	return len(l.Routes) == 0 || contains(l.Routes, routes)
+}
+
+// handler returns a router with the route groups of the listener. Admin routes are only
+// registered if there are admin users.
+func (l ListenerConfig) handler(users adminUsers) http.Handler {
+	router := httprouter.New()
+	if l.serves(RoutesWebhooks) {
+		router.POST("/docker/:apikey", hook)
+	}
+	if l.serves(RoutesMetrics) {
+		router.GET("/metrics", metricsHandler)
+	}
+	if l.serves(RoutesHealth) {
+		registerHealthRoutes(router)
+	}
+	if l.serves(RoutesAdmin) && users != nil {
+		registerAdminRoutes(router, users)
+	}
+	return withRequestID(router)
+}
+
+// listen opens the listener's address or takes it from the sockets passed by systemd
+func (l ListenerConfig) listen(activated map[string]net.Listener) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(l.Address, systemdPrefix):
+		name := strings.TrimPrefix(l.Address, systemdPrefix)
+		listener, found := activated[name]
+		if !found {
+			return nil, fmt.Errorf("systemd passed no socket %q", name)
+		}
+		return listener, nil
+	case strings.HasPrefix(l.Address, unixPrefix):
+		path := strings.TrimPrefix(l.Address, unixPrefix)
+		// Remove the socket of a previous process which wasn't shut down cleanly
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if l.Mode != "" {
+			mode, _ := strconv.ParseUint(l.Mode, 8, 32)
+			if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+				listener.Close()
+				return nil, err
+			}
+		}
+		return listener, nil
+	default:
+		return net.Listen("tcp", l.Address)
+	}
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation by their name and index.
+// The environment variables are removed so that scripts don't inherit them.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS: %+v", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(listenFDsStart+i), "systemd socket "+strconv.Itoa(i))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Can't use socket %d passed by systemd: %+v", i, err)
+		}
+		listeners[strconv.Itoa(i)] = listener
+		if i < len(names) && names[i] != "" {
+			listeners[names[i]] = listener
+		}
+	}
+	return listeners, nil
+}
+
+// serve starts a server for the listener in the background
+func (l ListenerConfig) serve(listener net.Listener, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	server := &http.Server{Addr: l.Address, Handler: handler}
+	if l.TLS {
+		server.TLSConfig = tlsConfig
+	}
+	routes := l.Routes
+	if len(routes) == 0 {
+		routes = allRoutes
+	}
+	go func() {
+		var err error
+		if l.TLS {
+			logger.Info("Now listening securely with HTTPS", "address", l.Address, "routes", strings.Join(routes, ","))
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			logger.Info("Now listening with HTTP", "address", l.Address, "routes", strings.Join(routes, ","))
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			fatal("Server stopped", "address", l.Address, "error", err)
+		}
+	}()
+	return server
+}
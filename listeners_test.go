@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadListeners(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-listeners-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "listeners.yml")
+	ioutil.WriteFile(path, []byte(`
+- address: ":8443"
+  tls: true
+  routes: [webhooks]
+- address: unix:/run/kranen/admin.sock
+  mode: "0660"
+  routes: [admin, metrics, health]
+`), 0600)
+	listeners, err := loadListeners(path)
+	assert.Nil(err)
+	assert.Equal([]ListenerConfig{
+		{Address: ":8443", TLS: true, Routes: []string{RoutesWebhooks}},
+		{Address: "unix:/run/kranen/admin.sock", Mode: "0660", Routes: []string{RoutesAdmin, RoutesMetrics, RoutesHealth}},
+	}, listeners)
+
+	for _, content := range []string{"[]", "- routes: [webhooks]", "- {address: ':80', routes: [dashboard]}", "- {address: ':80', mode: '0600'}", "- {address: 'unix:/tmp/s', mode: 'rw'}"} {
+		ioutil.WriteFile(path, []byte(content), 0600)
+		_, err = loadListeners(path)
+		assert.NotNil(err, content)
+	}
+}
+
+func TestListenerRoutes(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+	configs = []RepoConfig{{ApiKey: "foobaz", Name: "connctd/test", Tag: "latest"}}
+	users := adminUsers{"alice": "secret"}
+	status := func(handler http.Handler, method, path string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("alice", "secret")
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	all := ListenerConfig{Address: ":8080"}.handler(users)
+	assert.Equal(http.StatusOK, status(all, "GET", "/healthz"))
+	assert.Equal(http.StatusOK, status(all, "GET", "/metrics"))
+	assert.Equal(http.StatusOK, status(all, "GET", "/admin/runs"))
+	assert.Equal(http.StatusBadRequest, status(all, "POST", "/docker/foobaz"))
+
+	webhooks := ListenerConfig{Address: ":8080", Routes: []string{RoutesWebhooks}}.handler(users)
+	assert.Equal(http.StatusBadRequest, status(webhooks, "POST", "/docker/foobaz"))
+	assert.Equal(http.StatusNotFound, status(webhooks, "GET", "/healthz"))
+	assert.Equal(http.StatusNotFound, status(webhooks, "GET", "/metrics"))
+	assert.Equal(http.StatusNotFound, status(webhooks, "GET", "/admin/runs"))
+
+	admin := ListenerConfig{Address: ":9090", Routes: []string{RoutesAdmin, RoutesHealth}}.handler(nil)
+	assert.Equal(http.StatusOK, status(admin, "GET", "/healthz"))
+	assert.Equal(http.StatusNotFound, status(admin, "GET", "/admin/runs"))
+	assert.Equal(http.StatusNotFound, status(admin, "POST", "/docker/foobaz"))
+}
+
+func TestUnixListener(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-listeners-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	// A socket left behind by a crashed process is replaced
+	stale, err := net.Listen("unix", path)
+	assert.Nil(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := ListenerConfig{Address: "unix:" + path, Mode: "0660", Routes: []string{RoutesHealth}}
+	listener, err := config.listen(nil)
+	assert.Nil(err)
+	info, err := os.Stat(path)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0660), info.Mode().Perm())
+
+	server := config.serve(listener, config.handler(nil), nil)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://kranen/healthz")
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	assert.Nil(server.Shutdown(context.Background()))
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous int) { listenFDsStart = previous }(listenFDsStart)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	assert.Nil(err)
+	// systemdListeners closes the passed descriptors, so it gets a copy which nothing else closes
+	fd, err := syscall.Dup(int(file.Fd()))
+	assert.Nil(err)
+	file.Close()
+	listenFDsStart = fd
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "webhooks")
+	activated, err := systemdListeners()
+	assert.Nil(err)
+	assert.Equal("", os.Getenv("LISTEN_FDS"))
+	assert.Equal(activated["0"], activated["webhooks"])
+
+	passed, err := ListenerConfig{Address: "systemd:webhooks"}.listen(activated)
+	assert.Nil(err)
+	defer passed.Close()
+	assert.Equal(listener.Addr().String(), passed.Addr().String())
+	_, err = ListenerConfig{Address: "systemd:admin"}.listen(activated)
+	assert.NotNil(err)
+
+	// Sockets are ignored if they were passed to another process
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	activated, err = systemdListeners()
+	assert.Nil(err)
+	assert.Nil(activated)
+}
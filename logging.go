@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+	runKey
+	spanKey
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// setupLogging configures the global logger. The format is either logfmt or json and
+// the level one of debug, info, warn and error.
+func setupLogging(w io.Writer, format, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Invalid log level %s", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "logfmt":
+		logger = slog.New(slog.NewTextHandler(w, options))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, options))
+	default:
+		return fmt.Errorf("Invalid log format %s, use logfmt or json", format)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// fatal logs the message as error and exits
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// loggerFrom returns the logger stored in the context or the global logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// withRun makes the run available to the steps, which add their output to its log
+func withRun(ctx context.Context, run *Run) context.Context {
+	return context.WithValue(ctx, runKey, run)
+}
+
+func runFrom(ctx context.Context) *Run {
+	run, _ := ctx.Value(runKey).(*Run)
+	return run
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withRequestID assigns every request an ID, which is taken from the X-Request-ID header
+// if the client sent one, and makes a logger carrying it available in the request context
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRunID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = withLogger(ctx, logger.With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// logger returns a logger annotated with the IDs of the run and the request which caused it
+func (j Job) logger() *slog.Logger {
+	l := logger.With("run_id", j.Run.ID, "hook", j.Run.Hook)
+	if j.Run.RequestID != "" {
+		l = l.With("request_id", j.Run.RequestID)
+	}
+	return l
+}
+
+// lineWriter logs everything written to it line by line
+type lineWriter struct {
+	sync.Mutex
+	logger *slog.Logger
+	buffer []byte
+	// run and step are set if the lines are added to the log of a run
+	run    *Run
+	step   string
+	stream string
+}
+
+func newLineWriter(l *slog.Logger, stream string) *lineWriter {
+	return &lineWriter{logger: l.With("stream", stream), stream: stream}
+}
+
+// capture adds the lines to the log of the run as well
+func (l *lineWriter) capture(run *Run, step string) *lineWriter {
+	l.run = run
+	l.step = step
+	return l
+}
+
+func (l *lineWriter) writeLine(line string) {
+	l.logger.Info("script output", "line", line)
+	if l.run != nil {
+		history.appendLog(l.run, LogLine{Time: time.Now(), Step: l.step, Stream: l.stream, Line: line})
+	}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	l.buffer = append(l.buffer, p...)
+	for {
+		i := bytes.IndexByte(l.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		l.writeLine(string(bytes.TrimRight(l.buffer[:i], "\r")))
+		l.buffer = l.buffer[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs output which was not terminated by a newline
+func (l *lineWriter) Flush() {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.buffer) > 0 {
+		l.writeLine(string(l.buffer))
+		l.buffer = nil
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func decodeLogLines(t *testing.T, buffer *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid log line %s: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestSetupLogging(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous *slog.Logger) { logger = previous; slog.SetDefault(previous) }(logger)
+
+	var buffer bytes.Buffer
+	assert.Nil(setupLogging(&buffer, "logfmt", "warn"))
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "value")
+	assert.Equal(1, strings.Count(buffer.String(), "\n"))
+	assert.Contains(buffer.String(), `msg=shown key=value`)
+
+	assert.NotNil(setupLogging(&buffer, "xml", "info"))
+	assert.NotNil(setupLogging(&buffer, "json", "loud"))
+}
+
+func TestLineWriter(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	writer := newLineWriter(slog.New(slog.NewJSONHandler(&buffer, nil)), "stdout")
+
+	writer.Write([]byte("first\nsec"))
+	writer.Write([]byte("ond\r\nthird"))
+	writer.Flush()
+
+	lines := decodeLogLines(t, &buffer)
+	assert.Len(lines, 3)
+	assert.Equal("first", lines[0]["line"])
+	assert.Equal("second", lines[1]["line"])
+	assert.Equal("third", lines[2]["line"])
+	assert.Equal("stdout", lines[2]["stream"])
+}
+
+func TestRequestID(t *testing.T) {
+	assert := assert.New(t)
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/docker/foobaz", nil))
+	assert.NotEmpty(seen)
+	assert.Equal(seen, w.Header().Get(requestIDHeader))
+
+	req := httptest.NewRequest("POST", "/docker/foobaz", nil)
+	req.Header.Set(requestIDHeader, "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal("abc", seen)
+}
+
+func TestScriptOutputIsLoggedWithRunID(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous *slog.Logger) { logger = previous }(logger)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+
+	dir, err := ioutil.TempDir("", "kranen-logging-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	var buffer bytes.Buffer
+	logger = slog.New(slog.NewJSONHandler(&buffer, nil))
+	script := writeScript(t, dir, "deploy.sh", "echo deployed\necho oops >&2\n")
+	job := testJob(t, RepoConfig{ID: "test", Steps: []StepConfig{{Name: "deploy", Script: script}}})
+	assert.True(runPipeline(context.Background(), job))
+
+	var output []map[string]interface{}
+	for _, line := range decodeLogLines(t, &buffer) {
+		if line["msg"] == "script output" {
+			output = append(output, line)
+		}
+	}
+	assert.Len(output, 2)
+	for _, line := range output {
+		assert.Equal(job.Run.ID, line["run_id"])
+		assert.Equal("test", line["hook"])
+		assert.Equal("deploy", line["step"])
+	}
+	streams := map[interface{}]interface{}{output[0]["stream"]: output[0]["line"], output[1]["stream"]: output[1]["line"]}
+	assert.Equal(map[interface{}]interface{}{"stdout": "deployed", "stderr": "oops"}, streams)
+}
@@ -2,99 +2,321 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
-	"github.com/kabukky/httpscerts"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 var (
-	configFile      = flag.String("config", "", "Path to config.yml")
-	httpAddress     = flag.String("httpAddress", ":8080", "HTTP port")
-	certificatePath = flag.String("cert", "", "Path to the TLS certificate")
-	keyPath         = flag.String("key", "", "Path to the private key used for TLS")
-	autoTLS         = flag.Bool("tls", false, "Auto generate TLS key and certificate")
-	autoTLSHostname = flag.String("tlsHostname", "", "Hostname to use for the certificate")
+	configFile       = flag.String("config", "", "Path to the config file, YAML, JSON or TOML by its extension")
+	configDir        = flag.String("configDir", "", "Directory with further hook files (*.yml, *.yaml, *.json and *.toml), e.g. conf.d")
+	httpAddress      = flag.String("httpAddress", ":8080", "HTTP port")
+	certificatePath  = flag.String("cert", "", "Path to the TLS certificate")
+	keyPath          = flag.String("key", "", "Path to the private key used for TLS")
+	autoTLS          = flag.Bool("tls", false, "Auto generate TLS key and certificate")
+	autoTLSHostname  = flag.String("tlsHostname", "", "Hostname to use for the certificate")
+	autoTLSDir       = flag.String("tlsDir", "", "Directory for the generated certificate, defaults to the data dir")
+	tlsMinVersion    = flag.String("tlsMinVersion", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	tlsCipherSuites  = flag.String("tlsCipherSuites", "", "Comma separated cipher suites for TLS 1.2 and older, defaults to Go's secure suites")
+	hstsMaxAge       = flag.Duration("hsts", 0, "Send Strict-Transport-Security with this max-age on HTTPS responses, 0 disables it")
+	certPollInterval = flag.Duration("certPollInterval", time.Minute, "Interval in which the certificate files are checked for changes, 0 disables it")
+	acmeDomains      = flag.String("acmeDomains", "", "Comma separated host names to obtain certificates for via ACME, enables ACME")
+	acmeDirectory    = flag.String("acmeDirectory", acme.LetsEncryptURL, "Directory URL of the ACME CA")
+	acmeEmail        = flag.String("acmeEmail", "", "Contact email of the ACME account")
+	acmeCacheDir     = flag.String("acmeCacheDir", "", "Directory for the ACME account key and certificates, defaults to <dataDir>/acme")
+	acmeCA           = flag.String("acmeCA", "", "PEM file with CA certificates trusted for the ACME directory, e.g. for testing with Pebble")
+	acmeHTTPAddress  = flag.String("acmeHTTPAddress", ":80", "HTTP address answering ACME HTTP-01 challenges, empty to only use TLS-ALPN-01")
+	dataDir          = flag.String("dataDir", ".", "Directory to store state like the last successful deployments in")
+	adminUsersFile   = flag.String("adminUsers", "", "Path to a file with user:password lines, enables the admin API")
+	logFormat        = flag.String("logFormat", "logfmt", "Log format, logfmt or json")
+	logLevel         = flag.String("logLevel", "info", "Minimum log level: debug, info, warn or error")
+	adminAddress     = flag.String("adminAddress", "", "Separate HTTP address for health checks, metrics and the admin API")
+	listenersConfig  = flag.String("listeners", "", "Path to a YAML list of listeners and their routes, replaces -httpAddress and -adminAddress")
 
-	configs []RepoConfig
+	readyQueueThreshold = flag.Int("readyQueueThreshold", 10, "Number of queued jobs at which kranen reports not ready")
+	drainTimeout        = flag.Duration("drainTimeout", 5*time.Minute, "Time to wait for jobs on shutdown before scripts are stopped")
+	drainQueue          = flag.Bool("drainQueue", false, "Execute queued jobs on shutdown instead of only waiting for running ones")
+	notifyConfig        = flag.String("notifyConfig", "", "Path to a YAML list of notifiers informed about the runs of every hook")
+	otlpEndpoint        = flag.String("otlpEndpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP endpoint traces are exported to, e.g. http://localhost:4318")
+	serviceName         = flag.String("serviceName", "kranen", "Service name of exported traces")
+	queueMaxAge         = flag.Duration("queueMaxAge", time.Hour, "Discard queued jobs older than this instead of executing them, 0 keeps them forever")
+	auditLogPath        = flag.String("auditLog", "", "Path to a JSON lines file every trigger attempt is recorded in")
+	auditMaxSize        = flag.Int64("auditMaxSize", 100, "Size in MB at which the audit log is rotated, 0 disables rotation by size")
+	auditMaxAge         = flag.Duration("auditMaxAge", 0, "Age at which the audit log is rotated, e.g. 168h, 0 disables rotation by age")
+	auditSyslog         = flag.Bool("auditSyslog", false, "Send audit entries to the local syslog too")
 
-	scripTemplate = template.New("script")
+	configs []RepoConfig
 
-	executionChan chan ScriptCommand
+	executionChan chan Job
 )
 
 type tplData struct {
-	ENV map[string]string
-	Hub Payload
-}
-
-type ScriptCommand struct {
-	Cmd         *exec.Cmd
-	CallbackURL string
+	ENV   map[string]string
+	Hub   Payload
+	Steps map[string]*StepResult
+	// Previous is the last successful deployment of the hook, nil if there is none
+	Previous *Deployment
 }
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(os.Stderr, *logFormat, *logLevel); err != nil {
+		fatal("Can't setup logging", "error", err)
+	}
 	err := parseConfig()
 	if err != nil {
-		log.Fatalf("Can't load config: %+v", err)
+		fatal("Can't load config", "error", err)
+	}
+	// The config file may change the log settings
+	if err := setupLogging(os.Stderr, *logFormat, *logLevel); err != nil {
+		fatal("Can't setup logging", "error", err)
+	}
+	state, err = loadStateStore(*dataDir)
+	if err != nil {
+		fatal("Can't load state", "error", err)
+	}
+	if *notifyConfig != "" {
+		globalNotifiers, err = loadNotifiers(*notifyConfig)
+		if err != nil {
+			fatal("Can't load notifiers", "error", err)
+		}
 	}
 
-	executionChan = make(chan ScriptCommand)
+	if *auditLogPath != "" {
+		audit, err = openAuditLog(*auditLogPath, *auditMaxSize*1024*1024, *auditMaxAge)
+		if err != nil {
+			fatal("Can't open audit log", "error", err)
+		}
+	} else if *auditSyslog {
+		fatal("-auditSyslog needs -auditLog")
+	}
+	if *auditSyslog {
+		audit.syslog, err = openSyslog()
+		if err != nil {
+			fatal("Can't connect to syslog", "error", err)
+		}
+	}
+
+	if *otlpEndpoint != "" {
+		exporter = newSpanExporter(*otlpEndpoint, *serviceName)
+	}
+
+	if flag.NArg() > 0 {
+		code := runCommand(flag.Arg(0), flag.Args()[1:])
+		if exporter != nil {
+			exporter.Flush(serverShutdownTimeout)
+		}
+		os.Exit(code)
+	}
+
+	jobQueue, err = openDiskQueue(*dataDir)
+	if err != nil {
+		fatal("Can't open job queue", "error", err)
+	}
+	executionChan = make(chan Job)
 	go executeCommands()
-	defer close(executionChan)
+	if err := replayQueue(); err != nil {
+		fatal("Can't replay job queue", "error", err)
+	}
 
-	router := httprouter.New()
-	router.POST("/docker/:apikey", hook)
+	var users adminUsers
+	if *adminUsersFile != "" {
+		users, err = loadAdminUsers(*adminUsersFile)
+		if err != nil {
+			fatal("Can't load admin users", "error", err)
+		}
+	}
+	servers := make([]*http.Server, 0, 2)
 
+	var certManager *autocert.Manager
+	if *acmeDomains != "" {
+		if *autoTLS || *certificatePath != "" || *keyPath != "" {
+			fatal("-acmeDomains can't be combined with -tls, -cert or -key")
+		}
+		cacheDir := *acmeCacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(*dataDir, "acme")
+		}
+		certManager, err = newCertManager(ACMEConfig{
+			Domains:      strings.Split(*acmeDomains, ","),
+			DirectoryURL: *acmeDirectory,
+			Email:        *acmeEmail,
+			CacheDir:     cacheDir,
+			CAFile:       *acmeCA,
+		})
+		if err != nil {
+			fatal("Can't setup ACME", "error", err)
+		}
+		if *acmeHTTPAddress != "" {
+			challengeServer := &http.Server{Addr: *acmeHTTPAddress, Handler: certManager.HTTPHandler(nil)}
+			servers = append(servers, challengeServer)
+			go func() {
+				logger.Info("Answering ACME challenges with HTTP", "address", *acmeHTTPAddress)
+				if err := challengeServer.ListenAndServe(); err != http.ErrServerClosed {
+					fatal("ACME challenge server stopped", "error", err)
+				}
+			}()
+		}
+	}
 	if *autoTLS {
 		if *autoTLSHostname == "" {
-			log.Fatal("You need to specify a hostname for the generated certificate")
+			fatal("You need to specify a hostname for the generated certificate")
+		}
+		dir := *autoTLSDir
+		if dir == "" {
+			dir = *dataDir
+		}
+		*certificatePath, *keyPath, err = selfSignedCertificate(dir, *autoTLSHostname)
+		if err != nil {
+			fatal("Can't generate certificate", "error", err)
+		}
+	}
+	var tlsConfig *tls.Config
+	if certManager != nil || (*keyPath != "" && *certificatePath != "") {
+		tlsConfig, err = newTLSConfig(*tlsMinVersion, *tlsCipherSuites)
+		if err != nil {
+			fatal("Invalid TLS settings", "error", err)
 		}
-		err = httpscerts.Generate("cert.pem", "key.pem", *autoTLSHostname)
-		*keyPath = "key.pem"
-		*certificatePath = "cert.pem"
 	}
-	if *keyPath != "" && *certificatePath != "" {
-		log.Printf("Now listening securely with HTTPS on %s", *httpAddress)
-		log.Fatal(http.ListenAndServeTLS(*httpAddress, *certificatePath, *keyPath, router))
-	} else {
-		log.Printf("Now listening with HTTP on %s", *httpAddress)
-		log.Fatal(http.ListenAndServe(*httpAddress, router))
+	if certManager != nil {
+		acmeConfig := certManager.TLSConfig()
+		tlsConfig.GetCertificate = acmeConfig.GetCertificate
+		tlsConfig.NextProtos = acmeConfig.NextProtos
+	} else if tlsConfig != nil {
+		reloader, err := newCertReloader(*certificatePath, *keyPath)
+		if err != nil {
+			fatal("Can't load certificate", "error", err)
+		}
+		go reloader.watch(*certPollInterval)
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	}
+
+	listeners := defaultListeners(tlsConfig != nil)
+	if *listenersConfig != "" {
+		listeners, err = loadListeners(*listenersConfig)
+		if err != nil {
+			fatal("Can't load listeners", "error", err)
+		}
+	} else if len(serverListeners) > 0 {
+		listeners = serverListeners
+	}
+	activated, err := systemdListeners()
+	if err != nil {
+		fatal("Can't use sockets passed by systemd", "error", err)
+	}
+	for _, config := range listeners {
+		if config.TLS && tlsConfig == nil {
+			fatal("Listener needs a certificate, use -cert and -key, -tls or -acmeDomains", "address", config.Address)
+		}
+		listener, err := config.listen(activated)
+		if err != nil {
+			fatal("Can't listen", "address", config.Address, "error", err)
+		}
+		handler := config.handler(users)
+		if *hstsMaxAge > 0 {
+			handler = withHSTS(handler, *hstsMaxAge)
+		}
+		servers = append(servers, config.serve(listener, handler, tlsConfig))
 	}
+	waitForShutdown(servers...)
 }
 
 func executeCommands() {
-	for scriptCommand := range executionChan {
-		scriptCommand.Cmd.Stdout = os.Stdout
-		scriptCommand.Cmd.Stderr = os.Stderr
-		err := scriptCommand.Cmd.Run()
-		if err != nil {
-			log.Printf("Error running script: %+v", err)
+	executorAccepting.Store(true)
+	defer executorAccepting.Store(false)
+	for job := range executionChan {
+		queueDepth.Add(-1)
+		if (draining.Load() && !*drainQueue) || runContext.Err() != nil {
+			skipJob(job)
+			pendingJobs.Done()
 			continue
 		}
-		_, err = http.Get(scriptCommand.CallbackURL)
-		if err != nil {
-			log.Printf("Failed to call callback URL: %+v", err)
+		if isStale(job.Run, *queueMaxAge) {
+			discardJob(job)
+			pendingJobs.Done()
+			continue
+		}
+		ctx := withSpanContext(runContext, job.Trace)
+		_, waitSpan := startSpanAt(ctx, "queue wait", job.Run.Queued, "run_id", job.Run.ID)
+		waitSpan.End(nil)
+		ctx, runSpan := startSpan(ctx, "run", "run_id", job.Run.ID, "hook", job.Run.Hook, "trigger", job.Run.Trigger)
+		runningJobs.Add(1)
+		succeeded := runPipeline(ctx, job)
+		runningJobs.Add(-1)
+
+		run, _ := history.Get(job.Run.ID)
+		runDuration.Observe(run.Finished.Sub(run.Started).Seconds(), run.Hook)
+		runsTotal.Inc(run.Hook, string(run.Status))
+		if succeeded && job.Payload.CallbackUrl != "" {
+			sendCallback(ctx, job)
+		}
+		runSpan.SetAttributes("status", string(run.Status))
+		if succeeded {
+			runSpan.End(nil)
+		} else {
+			runSpan.End(fmt.Errorf("Run %s", run.Status))
 		}
+		// Interrupted runs stay in the queue and are executed again after a restart
+		if run.Status != StatusInterrupted {
+			if err := jobQueue.Ack(job); err != nil {
+				job.logger().Error("Can't remove job from queue", "error", err)
+			}
+		}
+		pendingJobs.Done()
 	}
 }
 
+func sendCallback(ctx context.Context, job Job) {
+	_, span := startSpan(ctx, "callback")
+	span.kind = spanKindClient
+	resp, err := http.Get(job.Payload.CallbackUrl)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("Callback responded with status %d", resp.StatusCode)
+		}
+	}
+	span.End(err)
+	if err != nil {
+		job.logger().Warn("Failed to call callback URL", "error", err)
+		callbacksTotal.Inc("failure")
+		return
+	}
+	callbacksTotal.Inc("success")
+}
+
 func parseConfig() error {
-	configBytes, err := ioutil.ReadFile(*configFile)
+	config, err := loadConfigFiles(*configFile, *configDir)
 	if err != nil {
 		return err
 	}
-	err = yaml.Unmarshal(configBytes, &configs)
+	if err := config.validate(); err != nil {
+		return err
+	}
+	explicit := explicitFlags()
+	if err := applyFlags(&config.Server, explicit); err != nil {
+		return err
+	}
+	if err := applyFlags(&config.TLS, explicit); err != nil {
+		return err
+	}
+	configs = config.Hooks
+	serverListeners = configListeners(config.Server.Listeners, explicit)
+	configLoaded.Store(true)
 	return nil
 }
 
@@ -113,47 +335,109 @@ func getConfigsForApiKey(apikey string) ([]RepoConfig, error) {
 }
 
 func hook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	if parent, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		ctx = withSpanContext(ctx, parent)
+	}
+	ctx, span := startSpan(ctx, "webhook", "http.method", r.Method, "http.route", "/docker/:apikey")
+	span.kind = spanKindServer
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	defer func() {
+		webhookRequests.Inc(sourceDockerHub, strconv.Itoa(recorder.status))
+		span.SetAttributes("http.status_code", strconv.Itoa(recorder.status))
+		var err error
+		if recorder.status >= 400 {
+			err = fmt.Errorf("Responded with status %d", recorder.status)
+		}
+		span.End(err)
+	}()
+
 	apiKey := ps.ByName("apikey")
+	entry := newAuditEntry(r, sourceDockerHub)
+	entry.KeyHash = hashKey(apiKey)
+	defer func() { audit.Record(entry) }()
+
+	log := loggerFrom(ctx)
+	if rejectWhileDraining(w) {
+		log.Warn("Rejected call while shutting down")
+		webhookRejections.Inc(rejectShuttingDown)
+		entry.reject(rejectShuttingDown)
+		return
+	}
 	configs, err := getConfigsForApiKey(apiKey)
 	if err != nil {
-		log.Printf("Api key %s does not exist", apiKey)
+		log.Warn("Api key does not exist", "api_key", apiKey)
+		webhookRejections.Inc(rejectUnknownKey)
+		entry.reject(rejectUnknownKey)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	_, decodeSpan := startSpan(ctx, "decode")
+	rawPayload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		decodeSpan.End(err)
+		log.Warn("Can't read payload from Docker Hub", "error", err)
+		webhookRejections.Inc(rejectBadPayload)
+		entry.reject(rejectBadPayload)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	var payload Payload
-	err = json.NewDecoder(r.Body).Decode(&payload)
+	err = json.Unmarshal(rawPayload, &payload)
+	if err == nil && (payload.PushData == nil || payload.Repo == nil) {
+		err = fmt.Errorf("push_data or repository missing")
+	}
+	decodeSpan.End(err)
 	if err != nil {
-		log.Printf("Can't parse payload from Docker Hub: %+v", err)
+		log.Warn("Can't parse payload from Docker Hub", "error", err)
+		webhookRejections.Inc(rejectBadPayload)
+		entry.reject(rejectBadPayload)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes("repo", payload.Repo.RepoName, "tag", payload.PushData.Tag)
+	entry.Repo, entry.Tag = payload.Repo.RepoName, payload.PushData.Tag
 
+	_, matchSpan := startSpan(ctx, "match")
 	dockerTag := payload.PushData.Tag
 	for _, repoConfig := range configs {
 		if repoConfig.Tag == dockerTag {
 			if payload.Repo.RepoName != repoConfig.Name {
-				log.Printf("Received call for repo %s but %s is configured as repo name, aborting", payload.Repo.RepoName, repoConfig.Name)
+				matchSpan.End(fmt.Errorf("Repository %s is not configured", payload.Repo.RepoName))
+				log.Warn("Received call for a repo which is not configured, aborting", "repo", payload.Repo.RepoName, "configured_repo", repoConfig.Name)
+				webhookRejections.Inc(rejectWrongName)
+				entry.reject(rejectWrongName)
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			log.Printf("Received valid call for key %s", apiKey)
-			go executeScript(repoConfig, payload)
+			matchSpan.SetAttributes("hook", repoConfig.HookID())
+			matchSpan.End(nil)
+			log.Info("Received valid call", "api_key", apiKey, "repo", payload.Repo.RepoName, "tag", dockerTag)
+			job := newJob(ctx, repoConfig, payload, rawPayload, TriggerWebhook)
+			span.SetAttributes("run_id", job.Run.ID)
+			if err := executeScript(job); err != nil {
+				job.logger().Error("Can't queue run", "error", err)
+				entry.reject(rejectQueueError)
+				entry.RunID = job.Run.ID
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			entry.accept(job.Run)
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 	}
-	log.Printf("Tag %s is not configured", dockerTag)
+	matchSpan.End(fmt.Errorf("Tag %s is not configured", dockerTag))
+	log.Warn("Tag is not configured", "tag", dockerTag)
+	webhookRejections.Inc(rejectWrongTag)
+	entry.reject(rejectWrongTag)
 	w.WriteHeader(http.StatusBadRequest)
 }
 
 var execCommand = exec.Command
 
-func executeScript(config RepoConfig, payload Payload) {
-	tpl, err := scripTemplate.Parse(config.Script)
-	if err != nil {
-		log.Printf("Can't parse script template: %+v", err)
-		return
-	}
+func templateData(payload Payload) tplData {
 	tplVars := tplData{
 		ENV: make(map[string]string),
 		Hub: payload,
@@ -163,24 +447,74 @@ func executeScript(config RepoConfig, payload Payload) {
 		if len(parts) == 2 {
 			tplVars.ENV[parts[0]] = parts[1]
 		} else {
-			log.Printf("Unusual environment value %s", envPair)
+			logger.Debug("Unusual environment value", "value", envPair)
 		}
 	}
-	var scriptBuffer bytes.Buffer
-	err = tpl.Execute(&scriptBuffer, tplVars)
+	return tplVars
+}
+
+func renderTemplate(name, text string, data interface{}) (string, error) {
+	tpl, err := template.New(name).Parse(text)
 	if err != nil {
-		log.Printf("Can't execute script template: %+v", err)
-		return
+		return "", fmt.Errorf("Can't parse %s template: %+v", name, err)
 	}
-	script := scriptBuffer.String()
-	log.Printf("Executing %s", script)
+	var buffer bytes.Buffer
+	err = tpl.Execute(&buffer, data)
+	if err != nil {
+		return "", fmt.Errorf("Can't execute %s template: %+v", name, err)
+	}
+	return buffer.String(), nil
+}
+
+// newJob creates a job for the event and adds its run to the history
+func newJob(ctx context.Context, config RepoConfig, payload Payload, rawPayload []byte, trigger string) Job {
+	run := &Run{
+		ID:        newRunID(),
+		Hook:      config.HookID(),
+		Repo:      payload.Repo.RepoName,
+		Tag:       payload.PushData.Tag,
+		Trigger:   trigger,
+		RequestID: requestIDFrom(ctx),
+		Status:    StatusQueued,
+		Queued:    time.Now(),
+	}
+	history.add(run)
+	return Job{
+		Run:        run,
+		Config:     config,
+		Payload:    payload,
+		RawPayload: rawPayload,
+		Trace:      spanContextFrom(ctx),
+	}
+}
+
+// executeScript persists the job and queues it for the executor without blocking the caller
+func executeScript(job Job) error {
+	if err := jobQueue.Put(job); err != nil {
+		history.update(job.Run, func(run *Run) {
+			run.Status = StatusFailed
+			run.Finished = time.Now()
+		})
+		return err
+	}
+	if job.Config.Debounce > 0 && job.Run.Trigger == TriggerWebhook {
+		debounce.add(job)
+		return nil
+	}
+	queueJob(job)
+	return nil
+}
 
-	args := strings.Split(script, " ")
-	scriptCommand := execCommand(args[0], args[1:]...)
-	scriptCommand.Env = os.Environ()
-	// TODO wrap this in a nicer writer
-	executionChan <- ScriptCommand{
-		Cmd:         scriptCommand,
-		CallbackURL: payload.CallbackUrl,
+// queueJob hands the job to the executor, jobs are executed in the order they were queued
+func queueJob(job Job) {
+	job.logger().Info("Queued run", "trigger", job.Run.Trigger, "tag", job.Run.Tag)
+	queueDepth.Add(1)
+	pendingJobs.Add(1)
+	backlog.Lock()
+	defer backlog.Unlock()
+	backlog.jobs = append(backlog.jobs, job)
+	if !backlog.sending {
+		backlog.sending = true
+		go sendBacklog()
 	}
 }
@@ -5,14 +5,16 @@ type PushData struct {
 	PushedAt float64 `json:"pushed_at"`
 	Pusher   string
 	Tag      string `json:"tag"`
+	// Digest is not sent by Docker Hub but can be given for manual triggers
+	Digest string `json:"digest,omitempty"`
 }
 
 type Repository struct {
 	CommentCount     int     `json:"comment_count"`
 	DateCreated      float64 `json:"date_created"`
 	Description      string
-	FulleDescription string `json:"full_description, omitempty"`
-	Dockerfile       string `json:"_, omitempty"`
+	FulleDescription string `json:"full_description,omitempty"`
+	Dockerfile       string `json:"_,omitempty"`
 	Official         bool   `json:"is_official"`
 	Private          bool   `json:"is_private"`
 	Trusted          bool   `json:"is_trusted"`
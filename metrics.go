@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is anything that can write itself in the Prometheus text exposition format
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metrics []metric
+
+	webhookRequests   = newCounterVec("kranen_webhook_requests_total", "Webhook requests by source and status code", "source", "code")
+	webhookRejections = newCounterVec("kranen_webhook_rejections_total", "Rejected webhook requests by reason", "reason")
+	queueDepth        = newGauge("kranen_queue_depth", "Jobs waiting for the executor")
+	runningJobs       = newGauge("kranen_running_jobs", "Jobs currently being executed")
+	runDuration       = newHistogramVec("kranen_run_duration_seconds", "Duration of runs per hook",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}, "hook")
+	runsTotal      = newCounterVec("kranen_runs_total", "Finished runs by hook and status", "hook", "status")
+	callbacksTotal = newCounterVec("kranen_callbacks_total", "Docker Hub callbacks by result", "result")
+)
+
+const (
+	sourceDockerHub = "dockerhub"
+
+	rejectUnknownKey = "unknown_key"
+	rejectWrongTag   = "wrong_tag"
+	rejectWrongName  = "wrong_name"
+	rejectBadPayload = "bad_payload"
+	// rejectShuttingDown counts events received while draining on shutdown
+	rejectShuttingDown = "shutting_down"
+)
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+	metrics = append(metrics, c)
+	return c
+}
+
+// Inc increments the counter with the given label values
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	key := labelKey(labelValues)
+	c.values[key]++
+	c.keys[key] = labelValues
+}
+
+// Value returns the current value of the counter with the given label values
+func (c *counterVec) Value(labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[labelKey(labelValues)]
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.keys[key]), formatValue(c.values[key]))
+	}
+}
+
+type gauge struct {
+	sync.Mutex
+	name  string
+	help  string
+	value float64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *gauge) Add(delta float64) {
+	g.Lock()
+	defer g.Unlock()
+	g.value += delta
+}
+
+func (g *gauge) Value() float64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.value
+}
+
+func (g *gauge) writeTo(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.value))
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name       string
+	help       string
+	labels     []string
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+	metrics = append(metrics, h)
+	return h
+}
+
+// Observe records a value in the histogram with the given label values
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := labelKey(labelValues)
+	hist, found := h.histograms[key]
+	if !found {
+		hist = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.histograms[key]
+		for i, bound := range h.buckets {
+			labels := formatLabels(h.labels, hist.labelValues, fmt.Sprintf("le=%q", formatValue(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, hist.counts[i])
+		}
+		labels := formatLabels(h.labels, hist.labelValues, `le="+Inf"`)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, hist.count)
+		labels = formatLabels(h.labels, hist.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hist.count)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+// statusRecorder remembers the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
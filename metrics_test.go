@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	assert := assert.New(t)
+
+	counter := &counterVec{name: "test_total", help: "Test counter", labels: []string{"hook"},
+		values: make(map[string]float64), keys: make(map[string][]string)}
+	counter.Inc("a")
+	counter.Inc("a")
+	counter.Inc(`b"c`)
+	var buffer bytes.Buffer
+	counter.writeTo(&buffer)
+	assert.Equal("# HELP test_total Test counter\n# TYPE test_total counter\n"+
+		"test_total{hook=\"a\"} 2\ntest_total{hook=\"b\\\"c\"} 1\n", buffer.String())
+
+	histogram := &histogramVec{name: "test_seconds", help: "Test histogram", labels: []string{"hook"},
+		buckets: []float64{1, 10}, histograms: make(map[string]*histogram)}
+	histogram.Observe(0.5, "a")
+	histogram.Observe(5, "a")
+	buffer.Reset()
+	histogram.writeTo(&buffer)
+	assert.Equal("# HELP test_seconds Test histogram\n# TYPE test_seconds histogram\n"+
+		"test_seconds_bucket{hook=\"a\",le=\"1\"} 1\n"+
+		"test_seconds_bucket{hook=\"a\",le=\"10\"} 2\n"+
+		"test_seconds_bucket{hook=\"a\",le=\"+Inf\"} 2\n"+
+		"test_seconds_sum{hook=\"a\"} 5.5\n"+
+		"test_seconds_count{hook=\"a\"} 2\n", buffer.String())
+}
+
+func TestHookMetrics(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+	prepare()
+
+	unknownKey := webhookRejections.Value(rejectUnknownKey)
+	wrongTag := webhookRejections.Value(rejectWrongTag)
+	wrongName := webhookRejections.Value(rejectWrongName)
+	badPayload := webhookRejections.Value(rejectBadPayload)
+	notFound := webhookRequests.Value(sourceDockerHub, "404")
+
+	testHook(successPayload, "wrongapikey", assert, http.StatusNotFound)
+	testHook(wrongTagPayload, "foobaz", assert, http.StatusBadRequest)
+	testHook(wrongNamePayload, "foobaz", assert, http.StatusBadRequest)
+	testHook(`{"callback_url": ""}`, "foobaz", assert, http.StatusBadRequest)
+
+	assert.Equal(unknownKey+1, webhookRejections.Value(rejectUnknownKey))
+	assert.Equal(wrongTag+1, webhookRejections.Value(rejectWrongTag))
+	assert.Equal(wrongName+1, webhookRejections.Value(rejectWrongName))
+	assert.Equal(badPayload+1, webhookRejections.Value(rejectBadPayload))
+	assert.Equal(notFound+1, webhookRequests.Value(sourceDockerHub, "404"))
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, &http.Request{}, httprouter.Params{})
+	assert.Contains(w.Body.String(), `kranen_webhook_rejections_total{reason="unknown_key"}`)
+	assert.Contains(w.Body.String(), "# TYPE kranen_queue_depth gauge")
+}
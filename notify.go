@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	NotifySlack      = "slack"
+	NotifyMattermost = "mattermost"
+	NotifyTeams      = "teams"
+	NotifyEmail      = "email"
+
+	EventStarted   = "started"
+	EventSucceeded = "succeeded"
+	EventFailed    = "failed"
+	EventTimedOut  = "timed_out"
+
+	defaultNotifyTimeout  = 5 * time.Second
+	defaultNotifyLogLines = 10
+)
+
+var defaultNotifyTemplates = map[string]string{
+	EventStarted:   "Deploying {{.Repo}}:{{.Tag}} pushed by {{.Pusher}} (hook {{.Hook}}, run {{.RunID}})",
+	EventSucceeded: "Deployed {{.Repo}}:{{.Tag}} pushed by {{.Pusher}} in {{.Duration}} (hook {{.Hook}}, run {{.RunID}})",
+	EventFailed: "Deployment of {{.Repo}}:{{.Tag}} pushed by {{.Pusher}} failed after {{.Duration}} (hook {{.Hook}}, run {{.RunID}}): {{.Error}}" +
+		"{{if .LogTail}}\n```\n{{.LogTail}}\n```{{end}}",
+	EventTimedOut: "Deployment of {{.Repo}}:{{.Tag}} pushed by {{.Pusher}} timed out after {{.Duration}} (hook {{.Hook}}, run {{.RunID}}): {{.Error}}" +
+		"{{if .LogTail}}\n```\n{{.LogTail}}\n```{{end}}",
+}
+
+var notifyColors = map[string]string{
+	EventStarted:   "439FE0",
+	EventSucceeded: "2EB67D",
+	EventFailed:    "E01E5A",
+	EventTimedOut:  "ECB22E",
+}
+
+// globalNotifiers are used for every hook in addition to the hook's own notifiers
+var globalNotifiers []NotifyConfig
+
+// NotifyConfig describes a chat webhook or an email address which is informed about runs
+type NotifyConfig struct {
+	// Type is slack, mattermost, teams or email
+	Type string `yaml:"type,omitempty"`
+	URL  string `yaml:"url,omitempty"`
+	// Events limits the notifications to these events, all events are sent if empty
+	Events []string `yaml:"events,omitempty"`
+	// Templates overrides the message templates per event
+	Templates map[string]string `yaml:"templates,omitempty"`
+	// Channel and Username override the defaults of Slack and Mattermost webhooks
+	Channel  string        `yaml:"channel,omitempty"`
+	Username string        `yaml:"username,omitempty"`
+	LogLines int           `yaml:"log_lines,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+
+	// SMTP, From, To, Subjects and AttachLog configure email notifiers
+	SMTP *SMTPConfig `yaml:"smtp,omitempty"`
+	From string      `yaml:"from,omitempty"`
+	To   []string    `yaml:"to,omitempty"`
+	// Subjects overrides the subject templates per event
+	Subjects  map[string]string `yaml:"subjects,omitempty"`
+	AttachLog bool              `yaml:"attach_log,omitempty"`
+}
+
+// NotificationData is available in notification templates
+type NotificationData struct {
+	Event    string
+	Hook     string
+	RunID    string
+	Trigger  string
+	Repo     string
+	Tag      string
+	Pusher   string
+	Duration time.Duration
+	Error    string
+	// LogTail contains the last lines of the run's log
+	LogTail string
+}
+
+func loadNotifiers(path string) ([]NotifyConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var notifiers []NotifyConfig
+	if err := yaml.Unmarshal(content, &notifiers); err != nil {
+		return nil, err
+	}
+	for _, notifier := range notifiers {
+		if err := notifier.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return notifiers, nil
+}
+
+func (n NotifyConfig) validate() error {
+	switch n.Type {
+	case NotifySlack, NotifyMattermost, NotifyTeams:
+		if n.URL == "" {
+			return fmt.Errorf("Notifier %s needs an url", n.Type)
+		}
+	case NotifyEmail:
+		if err := n.validateEmail(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown notifier type %q, use slack, mattermost, teams or email", n.Type)
+	}
+	for _, event := range n.Events {
+		if _, found := defaultNotifyTemplates[event]; !found {
+			return fmt.Errorf("Notifier %s: unknown event %q", n.Type, event)
+		}
+	}
+	for _, templates := range []map[string]string{n.Templates, n.Subjects} {
+		for event, text := range templates {
+			if _, found := defaultNotifyTemplates[event]; !found {
+				return fmt.Errorf("Notifier %s: template for unknown event %q", n.Type, event)
+			}
+			if _, err := template.New(event).Parse(text); err != nil {
+				return fmt.Errorf("Notifier %s: invalid %s template: %+v", n.Type, event, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (n NotifyConfig) wants(event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notify informs the global and the hook's notifiers about the event. The notifications are sent in
+// the background, failures are logged only.
+func notify(job Job, event string) {
+	notifiers := append(append([]NotifyConfig(nil), globalNotifiers...), job.Config.Notify...)
+	if len(notifiers) == 0 {
+		return
+	}
+	run, _ := history.Get(job.Run.ID)
+	data := NotificationData{
+		Event:   event,
+		Hook:    run.Hook,
+		RunID:   run.ID,
+		Trigger: run.Trigger,
+		Repo:    run.Repo,
+		Tag:     run.Tag,
+		Error:   runError(run),
+	}
+	if job.Payload.PushData != nil {
+		data.Pusher = job.Payload.PushData.Pusher
+	}
+	if event != EventStarted && !run.Finished.IsZero() {
+		data.Duration = run.Finished.Sub(run.Started).Round(100 * time.Millisecond)
+	}
+	log, _ := history.Log(run.ID)
+	for _, notifier := range notifiers {
+		if !notifier.wants(event) {
+			continue
+		}
+		lines := notifier.LogLines
+		if lines == 0 {
+			lines = defaultNotifyLogLines
+		}
+		data.LogTail = logTail(log, lines)
+		notifier, data := notifier, data
+		queue := notifications
+		if notifier.Type == NotifyEmail {
+			queue = emailNotifications
+		}
+		queue.add(func() {
+			var err error
+			if notifier.Type == NotifyEmail {
+				err = notifier.sendEmail(data, log)
+			} else {
+				err = notifier.send(data)
+			}
+			if err != nil {
+				job.logger().Warn("Failed to send notification", "type", notifier.Type, "event", event, "error", err)
+			}
+		})
+	}
+}
+
+var (
+	// notifications are sent one after another in the order of the events
+	notifications = new(deliveryQueue)
+	// emailNotifications have their own queue, an unreachable mail server blocks each email for
+	// the dial and session timeout and shouldn't delay chat notifications
+	emailNotifications = new(deliveryQueue)
+)
+
+// deliveryQueue sends notifications in the background, so notifiers which are slow or unreachable
+// don't hold up the executor
+type deliveryQueue struct {
+	sync.Mutex
+	deliveries []func()
+	sending    bool
+	// idle is closed once the queue is empty
+	idle chan struct{}
+}
+
+func (q *deliveryQueue) add(deliver func()) {
+	q.Lock()
+	defer q.Unlock()
+	q.deliveries = append(q.deliveries, deliver)
+	if !q.sending {
+		q.sending = true
+		q.idle = make(chan struct{})
+		go q.send()
+	}
+}
+
+// send executes the deliveries one after another and returns when the queue is empty
+func (q *deliveryQueue) send() {
+	for {
+		q.Lock()
+		if len(q.deliveries) == 0 {
+			q.sending = false
+			close(q.idle)
+			q.Unlock()
+			return
+		}
+		deliver := q.deliveries[0]
+		q.deliveries = q.deliveries[1:]
+		q.Unlock()
+		deliver()
+	}
+}
+
+// wait returns a channel which is closed once all deliveries added so far were sent
+func (q *deliveryQueue) wait() <-chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+	if !q.sending {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	return q.idle
+}
+
+// waitForNotifications waits until all notifications were sent or the timeout expired. It returns
+// true if all notifications were sent.
+func waitForNotifications(timeout time.Duration) bool {
+	expired := time.After(timeout)
+	for _, queue := range []*deliveryQueue{notifications, emailNotifications} {
+		select {
+		case <-queue.wait():
+		case <-expired:
+			return false
+		}
+	}
+	return true
+}
+
+// runError returns the error of the step which failed the run
+func runError(run Run) string {
+	for _, step := range run.Steps {
+		if step.Status == StatusFailed || step.Status == StatusInterrupted {
+			return step.Error
+		}
+	}
+	return ""
+}
+
+func logTail(log []LogLine, lines int) string {
+	if len(log) > lines {
+		log = log[len(log)-lines:]
+	}
+	result := make([]string, len(log))
+	for i, line := range log {
+		result[i] = line.Line
+	}
+	return strings.Join(result, "\n")
+}
+
+// send posts the notification to a chat webhook
+func (n NotifyConfig) send(data NotificationData) error {
+	text := n.Templates[data.Event]
+	if text == "" {
+		text = defaultNotifyTemplates[data.Event]
+	}
+	message, err := renderTemplate("notification", text, data)
+	if err != nil {
+		return err
+	}
+	var body interface{}
+	switch n.Type {
+	case NotifyTeams:
+		body = map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "http://schema.org/extensions",
+			"summary":    fmt.Sprintf("%s %s", data.Hook, data.Event),
+			"themeColor": notifyColors[data.Event],
+			"text":       message,
+		}
+	default:
+		fields := map[string]string{"text": message}
+		if n.Channel != "" {
+			fields["channel"] = n.Channel
+		}
+		if n.Username != "" {
+			fields["username"] = n.Username
+		}
+		body = fields
+	}
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = defaultNotifyTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", n.URL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chatStandIn records the JSON bodies posted to it
+type chatStandIn struct {
+	sync.Mutex
+	messages []map[string]string
+}
+
+func (c *chatStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var message map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.messages = append(c.messages, message)
+}
+
+func TestNotifications(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+	defer func(previous []NotifyConfig) { globalNotifiers = previous }(globalNotifiers)
+
+	slack := &chatStandIn{}
+	slackServer := httptest.NewServer(slack)
+	defer slackServer.Close()
+	teams := &chatStandIn{}
+	teamsServer := httptest.NewServer(teams)
+	defer teamsServer.Close()
+
+	dir, err := ioutil.TempDir("", "kranen-notify-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	deploy := writeScript(t, dir, "deploy.sh", "echo pulling\necho deployed\n")
+	slow := writeScript(t, dir, "slow.sh", "echo waiting for rollout >&2\nsleep 5\n")
+
+	globalNotifiers = []NotifyConfig{{Type: NotifySlack, URL: slackServer.URL, Channel: "#deployments"}}
+	config := RepoConfig{
+		ID:     "test",
+		Script: deploy,
+		Notify: []NotifyConfig{{
+			Type:      NotifyTeams,
+			URL:       teamsServer.URL,
+			Events:    []string{EventSucceeded, EventTimedOut},
+			Templates: map[string]string{EventSucceeded: "{{.Tag}} is live"},
+		}},
+	}
+	assert.Nil(config.validate())
+	job := testJob(t, config)
+	job.Run.Repo, job.Run.Tag = "connctd/test", "latest"
+	assert.True(runPipeline(context.Background(), job))
+	assert.True(waitForNotifications(10 * time.Second))
+
+	assert.Len(slack.messages, 2)
+	assert.Equal("#deployments", slack.messages[0]["channel"])
+	assert.Contains(slack.messages[0]["text"], "Deploying connctd/test:latest pushed by connctddev")
+	assert.Contains(slack.messages[1]["text"], "Deployed connctd/test:latest pushed by connctddev in ")
+	assert.Len(teams.messages, 1)
+	assert.Equal("MessageCard", teams.messages[0]["@type"])
+	assert.Equal("latest is live", teams.messages[0]["text"])
+
+	config.Script = ""
+	config.Steps = []StepConfig{{Name: "rollout", Script: slow, Timeout: 100 * time.Millisecond}}
+	job = testJob(t, config)
+	assert.False(runPipeline(context.Background(), job))
+	assert.True(waitForNotifications(10 * time.Second))
+	assert.Len(slack.messages, 4)
+	assert.Contains(slack.messages[3]["text"], "timed out after")
+	assert.Contains(slack.messages[3]["text"], "waiting for rollout")
+	assert.Len(teams.messages, 2)
+	assert.Contains(teams.messages[1]["text"], "Script timed out after 100ms")
+
+	assert.NotNil(NotifyConfig{Type: "irc", URL: slackServer.URL}.validate())
+	assert.NotNil(NotifyConfig{Type: NotifySlack, URL: slackServer.URL, Events: []string{"exploded"}}.validate())
+	assert.NotNil(NotifyConfig{Type: NotifySlack, URL: slackServer.URL, Templates: map[string]string{EventFailed: "{{"}}.validate())
+}
+
+func TestSlowNotifierDoesNotBlockRuns(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kranen-notify-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	config := RepoConfig{
+		ID:     "test",
+		Script: writeScript(t, dir, "deploy.sh", "true\n"),
+		Notify: []NotifyConfig{{Type: NotifySlack, URL: server.URL, Timeout: time.Minute}},
+	}
+	started := time.Now()
+	assert.True(runPipeline(context.Background(), testJob(t, config)))
+	assert.True(time.Since(started) < 10*time.Second)
+	assert.False(waitForNotifications(10 * time.Millisecond))
+
+	close(release)
+	assert.True(waitForNotifications(10 * time.Second))
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// outputEnvVar names the environment variable pointing to the file scripts can write
+// KEY=VALUE lines to, which are available to later steps as .Steps.<name>.Outputs.KEY
+const outputEnvVar = "KRANEN_OUTPUT"
+
+// scriptStopGrace is the time scripts get to exit after SIGTERM before they are killed
+var scriptStopGrace = 10 * time.Second
+
+// Job is an accepted event waiting for execution
+type Job struct {
+	Run        *Run
+	Config     RepoConfig
+	Payload    Payload
+	RawPayload []byte
+	// Trace is the span which caused the job, e.g. the webhook request
+	Trace spanContext
+}
+
+// runPipeline executes all steps of the job's hook and records the results in the run history.
+// Failed pipelines are executed again according to the hook's retry policy. If the last attempt
+// fails the hook's on_failure step is executed, if it succeeds the run is remembered as the last
+// successful deployment. If the context is cancelled running steps are stopped and the run is
+// recorded as interrupted. It returns true if the run succeeded.
+func runPipeline(ctx context.Context, job Job) bool {
+	steps := job.Config.Pipeline()
+	if job.Config.OnFailure != nil {
+		onFailure := job.Config.withHookSettings(*job.Config.OnFailure)
+		if onFailure.Name == "" {
+			onFailure.Name = "on_failure"
+		}
+		steps = append(steps, onFailure)
+	}
+	history.update(job.Run, func(run *Run) {
+		run.Status = StatusRunning
+		run.Started = time.Now()
+	})
+	notify(job, EventStarted)
+
+	var (
+		results []*StepResult
+		data    tplData
+		err     error
+	)
+	for attempt := 1; ; attempt++ {
+		results, data, err = runAttempt(ctx, job, steps, attempt)
+		if err == nil || ctx.Err() != nil || !job.Config.Retry.shouldRetry(attempt, err) {
+			break
+		}
+		delay := job.Config.Retry.delay(attempt)
+		job.logger().Warn("Attempt failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+		history.update(job.Run, func(run *Run) {
+			run.Status = StatusRetrying
+			if job.Config.OnFailure != nil {
+				results[len(results)-1].Status = StatusSkipped
+			}
+		})
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		history.update(job.Run, func(run *Run) {
+			run.Status = StatusRunning
+		})
+	}
+
+	interrupted := ctx.Err() != nil
+	failed := err != nil && !interrupted
+	if job.Config.OnFailure != nil {
+		onFailure := len(steps) - 1
+		if failed {
+			executeStep(ctx, job, steps[onFailure], results[onFailure], data)
+		} else {
+			history.update(job.Run, func(run *Run) {
+				results[onFailure].Status = StatusSkipped
+			})
+		}
+	}
+	history.update(job.Run, func(run *Run) {
+		run.Finished = time.Now()
+		switch {
+		case interrupted:
+			run.Status = StatusInterrupted
+		case failed:
+			run.Status = StatusFailed
+		default:
+			run.Status = StatusSucceeded
+		}
+	})
+	summary := make([]interface{}, 0, len(results))
+	for _, result := range results {
+		summary = append(summary, slog.String(result.Name, string(result.Status)))
+	}
+	run, _ := history.Get(job.Run.ID)
+	job.logger().Info("Run finished", "status", run.Status, "attempts", len(run.Attempts), slog.Group("steps", summary...))
+	switch {
+	case failed && isTimeout(err):
+		notify(job, EventTimedOut)
+	case failed:
+		notify(job, EventFailed)
+	case !interrupted:
+		notify(job, EventSucceeded)
+	}
+
+	if failed || interrupted {
+		return false
+	}
+	recordDeployment(job)
+	return true
+}
+
+// runAttempt executes the steps of the pipeline except on_failure and records the attempt in
+// the run history. It returns the error of the step which failed the pipeline.
+func runAttempt(ctx context.Context, job Job, steps []StepConfig, number int) ([]*StepResult, tplData, error) {
+	attempt := &Attempt{Number: number, Status: StatusRunning, Started: time.Now()}
+	results := make([]*StepResult, len(steps))
+	for i, step := range steps {
+		results[i] = &StepResult{Name: step.Name, Status: StatusQueued}
+	}
+	attempt.Steps = results
+	history.update(job.Run, func(run *Run) {
+		run.Steps = results
+		run.Attempts = append(run.Attempts, attempt)
+	})
+
+	data := templateData(job.Payload)
+	data.Steps = make(map[string]*StepResult)
+	if previous, found := state.LastSuccessful(job.Run.Hook); found {
+		data.Previous = &previous
+	}
+	mainSteps := len(steps)
+	if job.Config.OnFailure != nil {
+		mainSteps--
+	}
+	var failure error
+	for i, step := range steps[:mainSteps] {
+		if failure != nil || ctx.Err() != nil {
+			history.update(job.Run, func(run *Run) {
+				results[i].Status = StatusSkipped
+			})
+			continue
+		}
+		err := executeStep(ctx, job, step, results[i], data)
+		if err != nil && !step.ContinueOnError {
+			failure = err
+		}
+	}
+	if failure == nil && ctx.Err() != nil {
+		failure = ctx.Err()
+	}
+
+	history.update(job.Run, func(run *Run) {
+		attempt.Finished = time.Now()
+		switch {
+		case ctx.Err() != nil:
+			attempt.Status = StatusInterrupted
+		case failure != nil:
+			attempt.Status = StatusFailed
+			attempt.Error = failure.Error()
+		default:
+			attempt.Status = StatusSucceeded
+		}
+	})
+	return results, data, failure
+}
+
+func executeStep(ctx context.Context, job Job, step StepConfig, result *StepResult, data tplData) error {
+	history.update(job.Run, func(run *Run) {
+		result.Status = StatusRunning
+		result.Started = time.Now()
+	})
+	stepLogger := job.logger().With("step", step.Name)
+	stepCtx, span := startSpan(withRun(withLogger(ctx, stepLogger), job.Run), "step "+step.Name, "step", step.Name, "run_id", job.Run.ID)
+	stdout, outputs, err := runStep(stepCtx, step, data, job.RawPayload)
+	span.End(err)
+	history.update(job.Run, func(run *Run) {
+		result.Finished = time.Now()
+		result.Stdout = stdout
+		result.Outputs = outputs
+		switch {
+		case err != nil && ctx.Err() != nil:
+			result.Status = StatusInterrupted
+			result.Error = err.Error()
+		case err != nil:
+			result.Status = StatusFailed
+			result.Error = err.Error()
+		default:
+			result.Status = StatusSucceeded
+		}
+	})
+	data.Steps[step.Name] = result
+	if err != nil {
+		stepLogger.Warn("Step failed", "error", err)
+		history.appendLog(job.Run, LogLine{Time: time.Now(), Step: step.Name, Stream: "error", Line: err.Error()})
+	}
+	return err
+}
+
+func recordDeployment(job Job) {
+	payload := job.RawPayload
+	if len(payload) == 0 {
+		var err error
+		if payload, err = json.Marshal(job.Payload); err != nil {
+			job.logger().Error("Can't marshal payload", "error", err)
+			return
+		}
+	}
+	deployment := Deployment{
+		Repo:    job.Run.Repo,
+		Tag:     job.Run.Tag,
+		Digest:  job.Payload.PushData.Digest,
+		RunID:   job.Run.ID,
+		Time:    time.Now(),
+		Payload: payload,
+	}
+	if err := state.RecordSuccess(job.Run.Hook, deployment); err != nil {
+		job.logger().Error("Can't record deployment", "error", err)
+	}
+}
+
+func runStep(ctx context.Context, step StepConfig, data tplData, rawPayload []byte) (string, map[string]string, error) {
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+	switch {
+	case step.Script != "":
+		return runScriptStep(ctx, step, data)
+	case step.Forward != nil:
+		_, renderSpan := startSpan(ctx, "render")
+		forward, err := newForwardRequest(*step.Forward, data, rawPayload)
+		renderSpan.End(err)
+		if err != nil {
+			return "", nil, err
+		}
+		forwardCtx, span := startSpan(ctx, "forward", "urls", strings.Join(step.Forward.URLs, " "))
+		span.kind = spanKindClient
+		err = forward.Send(forwardCtx)
+		span.End(err)
+		return "", nil, err
+	case step.GitOps != nil:
+		_, renderSpan := startSpan(ctx, "render")
+		gitOps, err := newGitOpsRequest(*step.GitOps, data)
+		renderSpan.End(err)
+		if err != nil {
+			return "", nil, err
+		}
+		gitOpsCtx, span := startSpan(ctx, "gitops", "repository", step.GitOps.Repository)
+		err = gitOps.Apply(gitOpsCtx)
+		span.End(err)
+		return "", nil, err
+	}
+	return "", nil, fmt.Errorf("Step %s has no action", step.Name)
+}
+
+func runScriptStep(ctx context.Context, step StepConfig, data tplData) (string, map[string]string, error) {
+	_, renderSpan := startSpan(ctx, "render")
+	script, err := renderTemplate("script", step.Script, data)
+	if err != nil {
+		renderSpan.End(err)
+		return "", nil, err
+	}
+	env := make([]string, 0, len(step.Env))
+	for key, valueTemplate := range step.Env {
+		value, err := renderTemplate("env", valueTemplate, data)
+		if err != nil {
+			renderSpan.End(err)
+			return "", nil, err
+		}
+		env = append(env, key+"="+value)
+	}
+	renderSpan.End(nil)
+	outputFile, err := ioutil.TempFile("", "kranen-output")
+	if err != nil {
+		return "", nil, err
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	log := loggerFrom(ctx)
+	log.Info("Executing script", "script", script)
+	args := strings.Split(script, " ")
+	_, span := startSpan(ctx, "exec", "script", args[0])
+	scriptCommand := execCommand(args[0], args[1:]...)
+	scriptCommand.Env = append(os.Environ(), outputEnvVar+"="+outputFile.Name(), traceparentEnvVar+"="+span.context.Traceparent())
+	scriptCommand.Env = append(scriptCommand.Env, env...)
+	var stdout bytes.Buffer
+	run := runFrom(ctx)
+	stdoutLog := newLineWriter(log, "stdout").capture(run, step.Name)
+	stderrLog := newLineWriter(log, "stderr").capture(run, step.Name)
+	defer stdoutLog.Flush()
+	defer stderrLog.Flush()
+	scriptCommand.Stdout = io.MultiWriter(stdoutLog, &stdout)
+	scriptCommand.Stderr = stderrLog
+
+	startProcessGroup(scriptCommand)
+	if err := scriptCommand.Start(); err != nil {
+		span.End(err)
+		return "", nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- scriptCommand.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		stopScript(scriptCommand, done)
+		err = fmt.Errorf("Script was interrupted")
+		if ctx.Err() == context.DeadlineExceeded {
+			err = timeoutError{timeout: step.Timeout}
+		}
+	}
+	span.End(err)
+	if err != nil {
+		return strings.TrimSpace(stdout.String()), nil, err
+	}
+	outputs, err := readOutputs(outputFile.Name())
+	return strings.TrimSpace(stdout.String()), outputs, err
+}
+
+// timeoutError is returned if a script didn't finish within the step's timeout
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (t timeoutError) Error() string {
+	return fmt.Sprintf("Script timed out after %s", t.timeout)
+}
+
+// isTimeout reports whether the error was caused by a step exceeding its timeout
+func isTimeout(err error) bool {
+	var timeout timeoutError
+	return errors.As(err, &timeout) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// stopScript asks the script to terminate and kills it if it is still running after scriptStopGrace
+func stopScript(cmd *exec.Cmd, done chan error) {
+	signalProcessGroup(cmd, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(scriptStopGrace):
+		signalProcessGroup(cmd, os.Kill)
+		<-done
+	}
+}
+
+func readOutputs(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	outputs := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			outputs[strings.TrimSpace(parts[0])] = parts[1]
+		}
+	}
+	return outputs, scanner.Err()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeScript creates an executable shell script in dir and returns its path
+func writeScript(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testJob(t *testing.T, config RepoConfig) Job {
+	var payload Payload
+	if err := json.Unmarshal([]byte(successPayload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	run := &Run{ID: newRunID(), Hook: config.HookID(), Status: StatusQueued, Queued: time.Now()}
+	history.add(run)
+	return Job{Run: run, Config: config, Payload: payload, RawPayload: []byte(successPayload)}
+}
+
+func TestPipelineStepOutputs(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+
+	dir, err := ioutil.TempDir("", "kranen-pipeline-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	build := writeScript(t, dir, "build.sh", "echo building\necho IMAGE=connctd/test:42 >> $KRANEN_OUTPUT\n")
+	deploy := writeScript(t, dir, "deploy.sh", "echo \"$1 $TARGET\" > "+filepath.Join(dir, "deployed")+"\n")
+	config := RepoConfig{
+		Name: "connctd/test",
+		Tag:  "latest",
+		Steps: []StepConfig{
+			{Name: "build", Script: build},
+			{Name: "deploy", Script: deploy + " {{.Steps.build.Outputs.IMAGE}}", Env: map[string]string{"TARGET": "{{.Steps.build.Stdout}}"}},
+		},
+	}
+	assert.Nil(config.validate())
+
+	job := testJob(t, config)
+	assert.True(runPipeline(context.Background(), job))
+
+	deployed, err := ioutil.ReadFile(filepath.Join(dir, "deployed"))
+	assert.Nil(err)
+	assert.Equal("connctd/test:42 building\n", string(deployed))
+
+	run, found := history.Get(job.Run.ID)
+	assert.True(found)
+	assert.Equal(StatusSucceeded, run.Status)
+	assert.Len(run.Steps, 2)
+	assert.Equal("building", run.Steps[0].Stdout)
+	assert.Equal(StatusSucceeded, run.Steps[1].Status)
+}
+
+func TestPipelineFailures(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+
+	dir, err := ioutil.TempDir("", "kranen-pipeline-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	fail := writeScript(t, dir, "fail.sh", "exit 3\n")
+	slow := writeScript(t, dir, "slow.sh", "sleep 5\n")
+	ok := writeScript(t, dir, "ok.sh", "exit 0\n")
+	config := RepoConfig{
+		Steps: []StepConfig{
+			{Name: "optional", Script: fail, ContinueOnError: true},
+			{Name: "slow", Script: slow, Timeout: 50 * time.Millisecond},
+			{Name: "never", Script: ok},
+		},
+	}
+
+	job := testJob(t, config)
+	assert.False(runPipeline(context.Background(), job))
+
+	run, _ := history.Get(job.Run.ID)
+	assert.Equal(StatusFailed, run.Status)
+	assert.Equal(StatusFailed, run.Steps[0].Status)
+	assert.Equal(StatusFailed, run.Steps[1].Status)
+	assert.Contains(run.Steps[1].Error, "timed out")
+	assert.Equal(StatusSkipped, run.Steps[2].Status)
+}
+
+func TestLegacyPipeline(t *testing.T) {
+	assert := assert.New(t)
+	config := RepoConfig{
+		Script:  "/deploy.sh",
+		GitOps:  &GitOpsConfig{Repository: "/repo"},
+		Forward: []ForwardConfig{{URLs: []string{"http://localhost"}}},
+	}
+	steps := config.Pipeline()
+	assert.Len(steps, 3)
+	assert.Equal("script", steps[0].Name)
+	assert.Equal("gitops", steps[1].Name)
+	assert.Equal("forward1", steps[2].Name)
+	assert.Nil(config.validate())
+
+	config.Steps = []StepConfig{{Script: "/deploy.sh"}}
+	assert.NotNil(config.validate())
+
+	config = RepoConfig{Steps: []StepConfig{{Script: "/deploy.sh", Forward: &ForwardConfig{}}}}
+	assert.NotNil(config.validate())
+}
+
+func TestPipelineRetries(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+
+	dir, err := ioutil.TempDir("", "kranen-pipeline-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// flaky.sh fails with exit code 75 until it was called three times
+	counter := filepath.Join(dir, "counter")
+	flaky := writeScript(t, dir, "flaky.sh", "echo x >> "+counter+"\n[ $(wc -l < "+counter+") -ge 3 ] || exit 75\n")
+	fail := writeScript(t, dir, "fail.sh", "exit 1\n")
+	retry := &RetryConfig{MaxAttempts: 3, Backoff: 10 * time.Millisecond, ExitCodes: []int{75}}
+	config := RepoConfig{Steps: []StepConfig{{Name: "deploy", Script: flaky}}, OnFailure: &StepConfig{Script: fail}, Retry: retry}
+	assert.Nil(config.validate())
+
+	job := testJob(t, config)
+	assert.True(runPipeline(context.Background(), job))
+	run, _ := history.Get(job.Run.ID)
+	assert.Equal(StatusSucceeded, run.Status)
+	assert.Len(run.Attempts, 3)
+	assert.Equal(StatusFailed, run.Attempts[0].Status)
+	assert.Contains(run.Attempts[0].Error, "exit status 75")
+	assert.Equal(StatusSkipped, run.Attempts[0].Steps[1].Status)
+	assert.Equal(StatusSucceeded, run.Attempts[2].Status)
+	assert.Equal(StatusSkipped, run.Steps[1].Status)
+
+	// Other exit codes are not retried
+	config.Steps[0].Script = fail
+	job = testJob(t, config)
+	assert.False(runPipeline(context.Background(), job))
+	run, _ = history.Get(job.Run.ID)
+	assert.Equal(StatusFailed, run.Status)
+	assert.Len(run.Attempts, 1)
+	assert.Equal(StatusFailed, run.Steps[1].Status)
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert := assert.New(t)
+	retry := &RetryConfig{MaxAttempts: 10, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(time.Second, retry.delay(1))
+	assert.Equal(2*time.Second, retry.delay(2))
+	assert.Equal(4*time.Second, retry.delay(3))
+	assert.Equal(5*time.Second, retry.delay(4))
+
+	retry.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		delay := retry.delay(2)
+		assert.True(delay >= time.Second && delay <= 3*time.Second)
+	}
+	assert.NotNil(RepoConfig{Script: "/deploy.sh", Retry: &RetryConfig{}}.validate())
+	assert.NotNil(RepoConfig{Script: "/deploy.sh", Retry: &RetryConfig{MaxAttempts: 2, Jitter: 2}}.validate())
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup makes the command the leader of a new process group so that
+// children of scripts can be stopped together with the script
+func startProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup sends the signal to all processes in the command's process group
+func signalProcessGroup(cmd *exec.Cmd, signal os.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	sig, ok := signal.(syscall.Signal)
+	if !ok {
+		return cmd.Process.Signal(signal)
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
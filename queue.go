@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueDirName = "queue"
+
+// diskQueue persists accepted jobs until they were executed, so jobs survive crashes and
+// restarts. Every job is stored in its own file, named so that sorting the names restores
+// the order in which the jobs were accepted.
+type diskQueue struct {
+	dir string
+}
+
+// QueuedJob is the persisted form of a job
+type QueuedJob struct {
+	RunID     string    `json:"run_id"`
+	Hook      string    `json:"hook"`
+	Trigger   string    `json:"trigger"`
+	User      string    `json:"user,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Queued    time.Time `json:"queued"`
+	// Traceparent continues the trace of the webhook request after a restart
+	Traceparent string `json:"traceparent,omitempty"`
+	// Payload is stored as is, so forwarded bodies and their signatures don't change
+	Payload []byte `json:"payload"`
+}
+
+// jobQueue is nil if jobs are not persisted
+var jobQueue *diskQueue
+
+// backlog holds queued jobs in the order they were accepted until the executor takes them, so
+// callers don't wait for the executor and jobs for the same hook don't overtake each other
+var backlog struct {
+	sync.Mutex
+	jobs    []Job
+	sending bool
+}
+
+// sendBacklog hands the jobs of the backlog to the executor one after another and returns
+// when the backlog is empty
+func sendBacklog() {
+	for {
+		backlog.Lock()
+		if len(backlog.jobs) == 0 {
+			backlog.sending = false
+			backlog.Unlock()
+			return
+		}
+		job := backlog.jobs[0]
+		backlog.jobs = backlog.jobs[1:]
+		jobs := executionChan
+		backlog.Unlock()
+		jobs <- job
+	}
+}
+
+func openDiskQueue(dataDir string) (*diskQueue, error) {
+	dir := filepath.Join(dataDir, queueDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &diskQueue{dir: dir}, nil
+}
+
+func (q *diskQueue) path(run *Run) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d-%s.json", run.Queued.UnixNano(), run.ID))
+}
+
+// Put stores the job, it returns after the job was written to disk
+func (q *diskQueue) Put(job Job) error {
+	if q == nil {
+		return nil
+	}
+	content, err := json.Marshal(QueuedJob{
+		RunID:       job.Run.ID,
+		Hook:        job.Run.Hook,
+		Trigger:     job.Run.Trigger,
+		User:        job.Run.User,
+		RequestID:   job.Run.RequestID,
+		Queued:      job.Run.Queued,
+		Traceparent: job.Trace.Traceparent(),
+		Payload:     job.RawPayload,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path(job.Run), content, 0600)
+}
+
+// Ack removes the job after it was executed or discarded
+func (q *diskQueue) Ack(job Job) error {
+	if q == nil {
+		return nil
+	}
+	err := os.Remove(q.path(job.Run))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Pending returns all stored jobs in the order they were accepted
+func (q *diskQueue) Pending() ([]QueuedJob, error) {
+	if q == nil {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	jobs := make([]QueuedJob, 0, len(names))
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(q.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var job QueuedJob
+		if err := json.Unmarshal(content, &job); err != nil {
+			logger.Error("Can't parse queued job, removing it", "file", name, "error", err)
+			os.Remove(filepath.Join(q.dir, name))
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// isStale reports whether the job waited longer than the configured maximum age
+func isStale(run *Run, maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(run.Queued) > maxAge
+}
+
+// discardJob records a stale job as discarded instead of executing it
+func discardJob(job Job) {
+	history.update(job.Run, func(run *Run) {
+		run.Status = StatusDiscarded
+		run.Finished = time.Now()
+	})
+	job.logger().Warn("Discarding stale run", "queued", job.Run.Queued)
+	if err := jobQueue.Ack(job); err != nil {
+		job.logger().Error("Can't remove job from queue", "error", err)
+	}
+}
+
+// replayQueue queues the jobs which were accepted but not executed before kranen stopped
+func replayQueue() error {
+	pending, err := jobQueue.Pending()
+	if err != nil {
+		return err
+	}
+	for _, queued := range pending {
+		config, found := findHook(queued.Hook)
+		var payload Payload
+		if err := json.Unmarshal(queued.Payload, &payload); err != nil || payload.PushData == nil || payload.Repo == nil {
+			found = false
+		}
+		// Rollbacks don't call the Docker Hub callback, see rollbackJob
+		if queued.Trigger == TriggerRollback {
+			payload.CallbackUrl = ""
+		}
+		run := &Run{
+			ID:        queued.RunID,
+			Hook:      queued.Hook,
+			Trigger:   queued.Trigger,
+			User:      queued.User,
+			RequestID: queued.RequestID,
+			Status:    StatusQueued,
+			Queued:    queued.Queued,
+		}
+		job := Job{Run: run, Config: config, Payload: payload, RawPayload: queued.Payload}
+		job.Trace, _ = parseTraceparent(queued.Traceparent)
+		if !found {
+			logger.Error("Removing queued run of unknown hook or with invalid payload", "run_id", run.ID, "hook", run.Hook)
+			jobQueue.Ack(job)
+			continue
+		}
+		run.Repo = payload.Repo.RepoName
+		run.Tag = payload.PushData.Tag
+		history.add(run)
+		if isStale(run, *queueMaxAge) {
+			discardJob(job)
+			continue
+		}
+		job.logger().Info("Replaying queued run", "queued", run.Queued)
+		queueJob(job)
+	}
+	return nil
+}
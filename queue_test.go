@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskQueue(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-queue-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	queue, err := openDiskQueue(dir)
+	assert.Nil(err)
+	first := testJob(t, RepoConfig{ID: "first"})
+	first.Run.Queued = time.Now().Add(-time.Minute)
+	second := testJob(t, RepoConfig{ID: "second"})
+	second.Run.Queued = time.Now()
+	assert.Nil(queue.Put(second))
+	assert.Nil(queue.Put(first))
+
+	pending, err := queue.Pending()
+	assert.Nil(err)
+	assert.Len(pending, 2)
+	assert.Equal(first.Run.ID, pending[0].RunID)
+	assert.Equal("second", pending[1].Hook)
+	assert.Equal(successPayload, string(pending[1].Payload))
+
+	assert.Nil(queue.Ack(first))
+	assert.Nil(queue.Ack(first))
+	pending, err = queue.Pending()
+	assert.Nil(err)
+	assert.Len(pending, 1)
+}
+
+func TestQueueIsReplayedAfterRestart(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous *diskQueue) { jobQueue = previous }(jobQueue)
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+
+	dir, err := ioutil.TempDir("", "kranen-queue-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	jobQueue, err = openDiskQueue(dir)
+	assert.Nil(err)
+
+	deployed := writeScript(t, dir, "deploy.sh", "echo deployed >> "+dir+"/deployed\n")
+	slow := writeScript(t, dir, "slow.sh", "sleep 10\n")
+	configs = []RepoConfig{{ID: "deploy", Script: deployed}, {ID: "slow", Script: slow}}
+
+	// A job interrupted by the shutdown stays in the queue
+	stop := startTestExecutor(t)
+	interrupted := testJob(t, configs[1])
+	assert.Nil(executeScript(interrupted))
+	waitForStatus(t, interrupted.Run.ID, StatusRunning)
+	drain(10 * time.Millisecond)
+	waitForStatus(t, interrupted.Run.ID, StatusInterrupted)
+	stop()
+	pending, err := jobQueue.Pending()
+	assert.Nil(err)
+	assert.Len(pending, 1)
+	jobQueue.Ack(interrupted)
+
+	// Jobs written by a previous process aren't in the history yet
+	queued := func(hook string, age time.Duration) Job {
+		run := &Run{ID: newRunID(), Hook: hook, Trigger: TriggerWebhook, Queued: time.Now().Add(-age)}
+		return Job{Run: run, RawPayload: []byte(successPayload)}
+	}
+	fresh := queued("deploy", 0)
+	stale := queued("deploy", 2**queueMaxAge)
+	unknown := queued("removed", 0)
+	for _, job := range []Job{fresh, stale, unknown} {
+		assert.Nil(jobQueue.Put(job))
+	}
+
+	defer startTestExecutor(t)()
+	assert.Nil(replayQueue())
+	waitForStatus(t, fresh.Run.ID, StatusSucceeded)
+	waitForStatus(t, stale.Run.ID, StatusDiscarded)
+	content, err := ioutil.ReadFile(dir + "/deployed")
+	assert.Nil(err)
+	assert.Equal("deployed\n", string(content))
+
+	pendingJobs.Wait()
+	pending, err = jobQueue.Pending()
+	assert.Nil(err)
+	assert.Len(pending, 0)
+}
+
+func TestReplayedRollbackSkipsCallback(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous *diskQueue) { jobQueue = previous }(jobQueue)
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+
+	dir, err := ioutil.TempDir("", "kranen-queue-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	jobQueue, err = openDiskQueue(dir)
+	assert.Nil(err)
+	configs = []RepoConfig{{ID: "deploy", Script: writeScript(t, dir, "deploy.sh", "true\n")}}
+
+	var mutex sync.Mutex
+	var callbacks []string
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		callbacks = append(callbacks, r.URL.Path)
+	}))
+	defer callbackServer.Close()
+	queued := func(trigger, callback string) Job {
+		payload := strings.Replace(successPayload, "https://registry.hub.docker.com/u/connctd/gate/hook/25040jj1i4e2a4jc1ehbabb41hj45h0ef/", callbackServer.URL+callback, 1)
+		run := &Run{ID: newRunID(), Hook: "deploy", Trigger: trigger, Queued: time.Now()}
+		return Job{Run: run, RawPayload: []byte(payload)}
+	}
+	for _, job := range []Job{queued(TriggerWebhook, "/webhook"), queued(TriggerRollback, "/rollback")} {
+		assert.Nil(jobQueue.Put(job))
+	}
+
+	defer startTestExecutor(t)()
+	assert.Nil(replayQueue())
+	pendingJobs.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal([]string{"/webhook"}, callbacks)
+}
+
+func TestJobsAreExecutedInOrder(t *testing.T) {
+	assert := assert.New(t)
+	defer startTestExecutor(t)()
+
+	dir, err := ioutil.TempDir("", "kranen-queue-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	deploy := writeScript(t, dir, "deploy.sh", "echo $1 >> "+dir+"/deployed\n")
+	config := RepoConfig{ID: "deploy", Script: deploy + " {{.Hub.PushData.Tag}}"}
+
+	var expected string
+	for i := 0; i < 20; i++ {
+		job := testJob(t, config)
+		job.Payload.PushData.Tag = strconv.Itoa(i)
+		queueJob(job)
+		expected += strconv.Itoa(i) + "\n"
+	}
+	pendingJobs.Wait()
+	content, err := ioutil.ReadFile(dir + "/deployed")
+	assert.Nil(err)
+	assert.Equal(expected, string(content))
+}
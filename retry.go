@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultRetryBackoff    = 10 * time.Second
+	defaultRetryMaxBackoff = 5 * time.Minute
+)
+
+// shouldRetry reports whether a pipeline which failed with err in the given attempt is executed again
+func (r *RetryConfig) shouldRetry(attempt int, err error) bool {
+	if r == nil || attempt >= r.MaxAttempts {
+		return false
+	}
+	if len(r.ExitCodes) == 0 {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	for _, code := range r.ExitCodes {
+		if exitErr.ExitCode() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the time to wait after the given failed attempt
+func (r *RetryConfig) delay(attempt int) time.Duration {
+	delay := r.Backoff
+	if delay <= 0 {
+		delay = defaultRetryBackoff
+	}
+	maxDelay := r.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxBackoff
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if r.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(delay))
+	}
+	return delay
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rollbackCommand asks a running kranen to redeploy the last successful deployment of a hook via
+// the admin API, so the rollback is queued, recorded and audited like every other run
+func rollbackCommand(args []string) int {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	serverURL := flags.String("url", defaultServerURL(), "URL of the running kranen")
+	user := flags.String("user", os.Getenv("USER"), "Admin user")
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(os.Stderr, "Usage: kranen -config <path/to/config/yaml> rollback <hook> [-user <user>] [-url <kranen url>]")
+		return 2
+	}
+	hookID := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	run, err := postHookAction(*serverURL, *user, hookID, "rollback", nil)
+	if err != nil {
+		logger.Error("Rollback failed", "error", err)
+		return 1
+	}
+	fmt.Printf("Queued rollback %s for hook %s to tag %s\n", run.ID, run.Hook, run.Tag)
+	return 0
+}
+
+func findHook(id string) (RepoConfig, bool) {
+	for _, config := range configs {
+		if config.HookID() == id {
+			return config, true
+		}
+	}
+	return RepoConfig{}, false
+}
+
+// rollbackJob creates a job redeploying the last successful deployment of the hook.
+// The Docker Hub callback is not called again for rollbacks.
+func rollbackJob(ctx context.Context, hookID string) (Job, error) {
+	config, found := findHook(hookID)
+	if !found {
+		return Job{}, fmt.Errorf("Hook %s does not exist", hookID)
+	}
+	deployment, found := state.LastSuccessful(config.HookID())
+	if !found {
+		return Job{}, fmt.Errorf("Hook %s has no successful deployment to roll back to", hookID)
+	}
+	var payload Payload
+	if err := json.Unmarshal(deployment.Payload, &payload); err != nil {
+		return Job{}, fmt.Errorf("Can't parse payload of deployment %s: %+v", deployment.RunID, err)
+	}
+	payload.CallbackUrl = ""
+	return newJob(ctx, config, payload, deployment.Payload, TriggerRollback), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackOnFailure(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous func(string, ...string) *exec.Cmd) { execCommand = previous }(execCommand)
+	execCommand = exec.Command
+	defer func(previous *stateStore) { state = previous }(state)
+
+	dir, err := ioutil.TempDir("", "kranen-rollback-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	state, err = loadStateStore(dir)
+	assert.Nil(err)
+
+	deployed := filepath.Join(dir, "deployed")
+	deploy := writeScript(t, dir, "deploy.sh", "echo $1 > "+deployed+"\n")
+	fail := writeScript(t, dir, "fail.sh", "exit 1\n")
+	config := RepoConfig{
+		ID:        "test",
+		Name:      "connctd/test",
+		Tag:       "latest",
+		Steps:     []StepConfig{{Name: "deploy", Script: deploy + " {{.Hub.PushData.Tag}}"}},
+		OnFailure: &StepConfig{Script: deploy + " {{.Previous.Tag}}"},
+	}
+	assert.Nil(config.validate())
+
+	job := testJob(t, config)
+	job.Payload.PushData.Tag = "v1"
+	job.Run.Tag = "v1"
+	assert.True(runPipeline(context.Background(), job))
+	deployment, found := state.LastSuccessful("test")
+	assert.True(found)
+	assert.Equal("v1", deployment.Tag)
+
+	// The state is persisted in the data dir
+	reloaded, err := loadStateStore(dir)
+	assert.Nil(err)
+	deployment, found = reloaded.LastSuccessful("test")
+	assert.True(found)
+	assert.Equal(job.Run.ID, deployment.RunID)
+
+	config.Steps = append(config.Steps, StepConfig{Name: "verify", Script: fail})
+	job = testJob(t, config)
+	job.Payload.PushData.Tag = "v2"
+	job.Run.Tag = "v2"
+	assert.False(runPipeline(context.Background(), job))
+	content, err := ioutil.ReadFile(deployed)
+	assert.Nil(err)
+	assert.Equal("v1\n", string(content))
+	run, _ := history.Get(job.Run.ID)
+	assert.Equal(StatusFailed, run.Status)
+	assert.Equal("on_failure", run.Steps[2].Name)
+	assert.Equal(StatusSucceeded, run.Steps[2].Status)
+	deployment, _ = state.LastSuccessful("test")
+	assert.Equal("v1", deployment.Tag)
+}
+
+func TestRollbackJob(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous *stateStore) { state = previous }(state)
+	state = newStateStore("")
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+	configs = []RepoConfig{{ID: "test", Name: "connctd/test", Tag: "latest", Script: "/deploy.sh"}}
+
+	_, err := rollbackJob(context.Background(), "missing")
+	assert.NotNil(err)
+	_, err = rollbackJob(context.Background(), "test")
+	assert.NotNil(err)
+
+	state.RecordSuccess("test", Deployment{Repo: "connctd/test", Tag: "latest", RunID: "1", Payload: []byte(successPayload)})
+	job, err := rollbackJob(context.Background(), "test")
+	assert.Nil(err)
+	assert.Equal(TriggerRollback, job.Run.Trigger)
+	assert.Equal("latest", job.Payload.PushData.Tag)
+	assert.Equal("", job.Payload.CallbackUrl)
+}
+
+func TestRollbackCommand(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	defer func(previous *stateStore) { state = previous }(state)
+	state = newStateStore("")
+	server, jobs := adminTestServer(t)
+	defer server.Close()
+	os.Setenv("KRANEN_PASSWORD", "secret")
+	defer os.Unsetenv("KRANEN_PASSWORD")
+
+	// Without a successful deployment there is nothing to roll back to
+	assert.Equal(1, rollbackCommand([]string{"test", "-url", server.URL, "-user", "alice"}))
+
+	state.RecordSuccess("test", Deployment{Repo: "connctd/test", Tag: "latest", RunID: "1", Payload: []byte(successPayload)})
+	assert.Equal(0, rollbackCommand([]string{"test", "-url", server.URL, "-user", "alice"}))
+	job := <-jobs
+	assert.Equal(TriggerRollback, job.Run.Trigger)
+	assert.Equal("alice", job.Run.User)
+	assert.Equal("latest", job.Run.Tag)
+
+	assert.Equal(1, rollbackCommand([]string{"test", "-url", server.URL, "-user", "bob"}))
+	assert.Equal(2, rollbackCommand(nil))
+}
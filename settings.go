@@ -0,0 +1,439 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// configVersion is the version of the current config file format. Version 1 files are a plain list of hooks.
+const configVersion = 2
+
+// Config is the content of the config file
+type Config struct {
+	Version int `yaml:"version"`
+	// Include lists glob patterns of files with further hooks, relative to the config file
+	Include []string     `yaml:"include,omitempty"`
+	Server  ServerConfig `yaml:"server,omitempty"`
+	TLS     TLSConfig    `yaml:"tls,omitempty"`
+	// Defaults are used for fields which are not set by a hook or the templates it extends
+	Defaults *RepoConfig `yaml:"defaults,omitempty"`
+	// Templates are partial hooks which hooks and other templates can extend
+	Templates map[string]RepoConfig `yaml:"templates,omitempty"`
+	Hooks     []RepoConfig          `yaml:"hooks"`
+
+	// sources contains the file each hook was read from
+	sources []string
+	// hookFields, templateFields and defaultFields contain the fields set in the file by their YAML
+	// name, so fields explicitly set to their zero value aren't taken from templates and defaults
+	hookFields     []map[string]bool
+	templateFields map[string]map[string]bool
+	defaultFields  map[string]bool
+}
+
+// ServerConfig contains settings which can be given as flags as well, the flag wins if both are set
+type ServerConfig struct {
+	HTTPAddress  string `yaml:"http_address,omitempty" flag:"httpAddress"`
+	AdminAddress string `yaml:"admin_address,omitempty" flag:"adminAddress"`
+	DataDir      string `yaml:"data_dir,omitempty" flag:"dataDir"`
+	AdminUsers   string `yaml:"admin_users,omitempty" flag:"adminUsers"`
+	LogFormat    string `yaml:"log_format,omitempty" flag:"logFormat"`
+	LogLevel     string `yaml:"log_level,omitempty" flag:"logLevel"`
+	// Listeners replace http_address and admin_address, -listeners wins if both are set
+	Listeners []ListenerConfig `yaml:"listeners,omitempty"`
+}
+
+// TLSConfig contains the TLS settings of the listeners, the flag wins if both are set
+type TLSConfig struct {
+	Cert string `yaml:"cert,omitempty" flag:"cert"`
+	Key  string `yaml:"key,omitempty" flag:"key"`
+	// SelfSigned generates a certificate for Hostname
+	SelfSigned       bool          `yaml:"self_signed,omitempty" flag:"tls"`
+	Hostname         string        `yaml:"hostname,omitempty" flag:"tlsHostname"`
+	Dir              string        `yaml:"dir,omitempty" flag:"tlsDir"`
+	MinVersion       string        `yaml:"min_version,omitempty" flag:"tlsMinVersion"`
+	CipherSuites     []string      `yaml:"cipher_suites,omitempty" flag:"tlsCipherSuites"`
+	HSTS             time.Duration `yaml:"hsts,omitempty" flag:"hsts"`
+	CertPollInterval time.Duration `yaml:"cert_poll_interval,omitempty" flag:"certPollInterval"`
+	ACME             ACMEConfig    `yaml:"acme,omitempty"`
+}
+
+// serverListeners are the listeners of the config file
+var serverListeners []ListenerConfig
+
+// loadConfig reads the config file in the format given by its extension, a plain list of hooks
+// is read as version 1 file. The second result is the version of the file.
+func loadConfig(path string) (Config, int, error) {
+	var config Config
+	document, err := readConfigFile(path)
+	if err != nil {
+		return config, 0, err
+	}
+	switch document.value.(type) {
+	case nil, []interface{}:
+		config.Version = configVersion
+		config.recordFields(document.value)
+		return config, 1, document.decode(&config.Hooks)
+	}
+	if err := document.decode(&config); err != nil {
+		return config, 0, err
+	}
+	config.recordFields(document.value)
+	if config.Version != configVersion {
+		return config, config.Version, fmt.Errorf("Unsupported config version %d, expected version: %d or a list of hooks", config.Version, configVersion)
+	}
+	return config, config.Version, nil
+}
+
+// loadConfigFiles reads the config file and the hook files it includes or which are in dir. Either
+// path or dir may be empty.
+func loadConfigFiles(path, dir string) (Config, error) {
+	config := Config{Version: configVersion}
+	var patterns []string
+	if path != "" {
+		var err error
+		config, _, err = loadConfig(path)
+		if err != nil {
+			return config, fmt.Errorf("%s: %+v", path, err)
+		}
+		for range config.Hooks {
+			config.sources = append(config.sources, path)
+		}
+		for _, pattern := range config.Include {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	if path == "" && dir == "" {
+		return config, fmt.Errorf("No config given, use -config or -configDir")
+	}
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return config, fmt.Errorf("Invalid include pattern %q: %+v", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	if dir != "" {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			return config, err
+		}
+		for _, match := range matches {
+			if isConfigFile(match) {
+				files = append(files, match)
+			}
+		}
+	}
+	// Files are compared by their absolute path, so the config file isn't loaded again when it is
+	// matched by an include pattern or lies in the config directory
+	loaded := map[string]bool{absPath(path): true}
+	for _, file := range files {
+		if loaded[absPath(file)] {
+			continue
+		}
+		loaded[absPath(file)] = true
+		included, err := loadHookFile(file)
+		if err != nil {
+			return config, fmt.Errorf("%s: %+v", file, err)
+		}
+		for i, hook := range included.Hooks {
+			config.Hooks = append(config.Hooks, hook)
+			config.hookFields = append(config.hookFields, included.fields(i))
+			config.sources = append(config.sources, file)
+		}
+	}
+	return config, nil
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// loadHookFile reads an included file, which is a list of hooks or a config containing only hooks
+func loadHookFile(path string) (Config, error) {
+	var config Config
+	document, err := readConfigFile(path)
+	if err != nil {
+		return config, err
+	}
+	config.recordFields(document.value)
+	switch document.value.(type) {
+	case nil, []interface{}:
+		err = document.decode(&config.Hooks)
+		return config, err
+	}
+	if err := document.decode(&config); err != nil {
+		return config, err
+	}
+	if config.Version != 0 && config.Version != configVersion {
+		return config, fmt.Errorf("Unsupported config version %d", config.Version)
+	}
+	if len(config.Include) > 0 || !reflect.ValueOf(config.Server).IsZero() || !reflect.ValueOf(config.TLS).IsZero() || config.Defaults != nil || len(config.Templates) > 0 {
+		return config, fmt.Errorf("Included files may only contain hooks")
+	}
+	return config, nil
+}
+
+// recordFields remembers the fields the hooks, templates and defaults of the document set
+func (c *Config) recordFields(document interface{}) {
+	hooks, _ := document.([]interface{})
+	if mapping, ok := document.(map[string]interface{}); ok {
+		hooks, _ = mapping["hooks"].([]interface{})
+		c.defaultFields = fieldNames(mapping["defaults"])
+		if templates, ok := mapping["templates"].(map[string]interface{}); ok {
+			c.templateFields = make(map[string]map[string]bool, len(templates))
+			for name, template := range templates {
+				c.templateFields[name] = fieldNames(template)
+			}
+		}
+	}
+	c.hookFields = make([]map[string]bool, len(hooks))
+	for i, hook := range hooks {
+		c.hookFields[i] = fieldNames(hook)
+	}
+}
+
+func fieldNames(document interface{}) map[string]bool {
+	mapping, _ := document.(map[string]interface{})
+	names := make(map[string]bool, len(mapping))
+	for name := range mapping {
+		names[name] = true
+	}
+	return names
+}
+
+// fields returns a copy of the fields set by the hook at index i
+func (c *Config) fields(i int) map[string]bool {
+	fields := make(map[string]bool)
+	if i < len(c.hookFields) {
+		for name := range c.hookFields[i] {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// source returns the file the hook at index i was read from
+func (c *Config) source(i int) string {
+	if i < len(c.sources) {
+		return c.sources[i]
+	}
+	return ""
+}
+
+// validate checks the hooks and listeners and applies the templates and defaults to the hooks
+func (c *Config) validate() error {
+	if c.Defaults != nil && (c.Defaults.ID != "" || c.Defaults.Extends != "") {
+		return fmt.Errorf("Defaults can't set an id or extend a template")
+	}
+	for name, template := range c.Templates {
+		if template.ID != "" {
+			return fmt.Errorf("Template %s can't set an id", name)
+		}
+	}
+	for i := range c.Hooks {
+		err := c.resolve(&c.Hooks[i], c.fields(i))
+		if err == nil {
+			err = c.Hooks[i].validate()
+		}
+		if err != nil {
+			if source := c.source(i); source != "" {
+				return fmt.Errorf("%s: %+v", source, err)
+			}
+			return err
+		}
+	}
+	c.separateDefaultIDs()
+	defined := make(map[string]int)
+	for i := range c.Hooks {
+		id := c.Hooks[i].HookID()
+		if previous, found := defined[id]; found {
+			return fmt.Errorf("Hook %s is defined twice, in %s and %s, set id to tell them apart", id, c.source(previous), c.source(i))
+		}
+		defined[id] = i
+	}
+	for _, listener := range c.Server.Listeners {
+		if err := listener.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// separateDefaultIDs sets the ID of hooks without one which share the repository and tag with
+// hooks of other API keys. Such hooks are valid, webhooks are matched by their key, so they get
+// the default ID followed by the hash of their key, e.g. connctd/test:latest@9f86d081.
+func (c *Config) separateDefaultIDs() {
+	keys := make(map[string]map[string]bool)
+	for _, hook := range c.Hooks {
+		if hook.ID != "" {
+			continue
+		}
+		if keys[hook.HookID()] == nil {
+			keys[hook.HookID()] = make(map[string]bool)
+		}
+		keys[hook.HookID()][hook.ApiKey] = true
+	}
+	for i := range c.Hooks {
+		hook := &c.Hooks[i]
+		if hook.ID == "" && len(keys[hook.HookID()]) > 1 {
+			hook.ID = hook.HookID() + "@" + hashKey(hook.ApiKey)[:8]
+		}
+	}
+}
+
+// resolve applies the templates the hook extends and then the defaults. Every field is taken
+// from the first of them which sets it as a whole, lists and nested blocks are not merged. fields
+// contains the fields set by the hook itself.
+func (c *Config) resolve(hook *RepoConfig, fields map[string]bool) error {
+	extended := make(map[string]bool)
+	for hook.Extends != "" {
+		name := hook.Extends
+		template, found := c.Templates[name]
+		if !found {
+			return fmt.Errorf("Hook %s extends unknown template %s", hook.HookID(), name)
+		}
+		if extended[name] {
+			return fmt.Errorf("Hook %s: templates extend each other in a cycle at %s", hook.HookID(), name)
+		}
+		extended[name] = true
+		// The template's extends field continues the chain
+		hook.Extends = ""
+		delete(fields, "extends")
+		mergeConfig(hook, fields, template, c.templateFields[name])
+	}
+	if c.Defaults != nil {
+		mergeConfig(hook, fields, *c.Defaults, c.defaultFields)
+	}
+	return nil
+}
+
+// actionFields are taken as a unit, only if the hook sets none of them
+var actionFields = []string{"script", "gitops", "forward", "steps"}
+
+// mergeConfig sets all fields of the hook which are not set to the value of the defaults. A field
+// is set if it is not empty or given in fields, which contains the fields set in the file. Fields
+// taken from the defaults are added to fields.
+func mergeConfig(hook *RepoConfig, fields map[string]bool, defaults RepoConfig, defaultFields map[string]bool) {
+	target, source := reflect.ValueOf(hook).Elem(), reflect.ValueOf(defaults)
+	isSet := func(name string) bool {
+		return fields[name] || !target.FieldByIndex(repoConfigFields[name].Index).IsZero()
+	}
+	hasActions := false
+	for _, name := range actionFields {
+		hasActions = hasActions || isSet(name)
+	}
+	for name, field := range repoConfigFields {
+		if isSet(name) || (hasActions && contains(actionFields, name)) {
+			continue
+		}
+		target.FieldByIndex(field.Index).Set(source.FieldByIndex(field.Index))
+		if defaultFields[name] {
+			fields[name] = true
+		}
+	}
+}
+
+var repoConfigFields = yamlFields(reflect.TypeOf(RepoConfig{}))
+
+// configListeners returns the listeners of the config file unless -httpAddress or -adminAddress
+// was given on the command line. Like every other flag they win over the config file, kranen then
+// listens on the addresses of the flags.
+func configListeners(listeners []ListenerConfig, explicit map[string]bool) []ListenerConfig {
+	if len(listeners) > 0 && (explicit["httpAddress"] || explicit["adminAddress"]) {
+		logger.Warn("Ignoring server.listeners of the config file because -httpAddress or -adminAddress is set")
+		return nil
+	}
+	return listeners
+}
+
+// explicitFlags returns the names of the flags given on the command line
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// applyFlags sets the flags of all fields tagged with flag to the field's value unless the field
+// is empty or the flag was given on the command line
+func applyFlags(settings interface{}, explicit map[string]bool) error {
+	return visitFlagFields(reflect.ValueOf(settings).Elem(), func(name string, field reflect.Value) error {
+		if explicit[name] || field.IsZero() {
+			return nil
+		}
+		value := fmt.Sprint(field.Interface())
+		if list, ok := field.Interface().([]string); ok {
+			value = strings.Join(list, ",")
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid value %q for -%s: %+v", value, name, err)
+		}
+		return nil
+	})
+}
+
+// settingsFromFlags sets all fields tagged with flag whose flag was given on the command line
+func settingsFromFlags(settings interface{}, explicit map[string]bool) {
+	visitFlagFields(reflect.ValueOf(settings).Elem(), func(name string, field reflect.Value) error {
+		if !explicit[name] {
+			return nil
+		}
+		value := flag.Lookup(name).Value.(flag.Getter).Get()
+		if _, ok := field.Interface().([]string); ok {
+			value = strings.Split(value.(string), ",")
+		}
+		field.Set(reflect.ValueOf(value))
+		return nil
+	})
+}
+
+func visitFlagFields(value reflect.Value, visit func(name string, field reflect.Value) error) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if name := value.Type().Field(i).Tag.Get("flag"); name != "" {
+			if err := visit(name, field); err != nil {
+				return err
+			}
+		} else if field.Kind() == reflect.Struct {
+			if err := visitFlagFields(field, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// effectiveConfig returns the loaded hooks with templates and defaults applied and the settings
+// currently in effect, including the values of flags which were not set
+func effectiveConfig() Config {
+	all := make(map[string]bool)
+	flag.VisitAll(func(f *flag.Flag) {
+		all[f.Name] = f.Value.String() != ""
+	})
+	config := Config{Version: configVersion, Hooks: configs}
+	settingsFromFlags(&config.Server, all)
+	settingsFromFlags(&config.TLS, all)
+	config.Server.Listeners = serverListeners
+	return config
+}
+
+// migrateConfig converts a version 1 config into the current format. Settings given as flags
+// are moved to the config file.
+func migrateConfig(hooks []RepoConfig, explicit map[string]bool) Config {
+	config := Config{Version: configVersion, Hooks: hooks}
+	settingsFromFlags(&config.Server, explicit)
+	settingsFromFlags(&config.TLS, explicit)
+	return config
+}
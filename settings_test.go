@@ -0,0 +1,371 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const configV2 = `
+version: 2
+server:
+  http_address: ":8443"
+  data_dir: /var/lib/kranen
+  listeners:
+    - address: ":8443"
+      tls: true
+      routes: [webhooks]
+tls:
+  cert: /etc/kranen/cert.pem
+  key: /etc/kranen/key.pem
+  cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]
+  hsts: 8760h
+defaults:
+  api_key: foobaz
+  tag: latest
+hooks:
+  - name: connctd/test
+    script: /deploy.sh
+  - name: connctd/other
+    api_key: other
+    tag: stable
+    script: /deploy-other.sh
+`
+
+func writeConfig(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-settings-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	config, version, err := loadConfig(writeConfig(t, dir, configV2))
+	assert.Nil(err)
+	assert.Equal(2, version)
+	assert.Nil(config.validate())
+	assert.Equal(":8443", config.Server.HTTPAddress)
+	assert.Equal([]ListenerConfig{{Address: ":8443", TLS: true, Routes: []string{RoutesWebhooks}}}, config.Server.Listeners)
+	assert.Equal(8760*time.Hour, config.TLS.HSTS)
+	assert.Equal(2, len(config.Hooks))
+	assert.Equal(RepoConfig{Name: "connctd/test", ApiKey: "foobaz", Tag: "latest", Script: "/deploy.sh"}, config.Hooks[0])
+	assert.Equal(RepoConfig{Name: "connctd/other", ApiKey: "other", Tag: "stable", Script: "/deploy-other.sh"}, config.Hooks[1])
+
+	// Version 1 files are a list of hooks
+	config, version, err = loadConfig(writeConfig(t, dir, "- name: connctd/test\n  api_key: foobaz\n  tag: latest\n"))
+	assert.Nil(err)
+	assert.Equal(1, version)
+	assert.Equal([]RepoConfig{{Name: "connctd/test", ApiKey: "foobaz", Tag: "latest"}}, config.Hooks)
+
+	for _, content := range []string{"version: 3\nhooks: []", "hooks:\n  - name: connctd/test"} {
+		_, _, err = loadConfig(writeConfig(t, dir, content))
+		assert.NotNil(err, content)
+	}
+	config, _, err = loadConfig(writeConfig(t, dir, "version: 2\ndefaults:\n  id: shared\nhooks: []"))
+	assert.Nil(err)
+	assert.NotNil(config.validate())
+}
+
+func TestApplyFlags(t *testing.T) {
+	assert := assert.New(t)
+	defer func(address, cert, suites string, hsts time.Duration) {
+		*httpAddress, *certificatePath, *tlsCipherSuites, *hstsMaxAge = address, cert, suites, hsts
+	}(*httpAddress, *certificatePath, *tlsCipherSuites, *hstsMaxAge)
+	dir, err := ioutil.TempDir("", "kranen-settings-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	config, _, err := loadConfig(writeConfig(t, dir, configV2))
+	assert.Nil(err)
+	*httpAddress = ":9000"
+	explicit := map[string]bool{"httpAddress": true}
+	assert.Nil(applyFlags(&config.Server, explicit))
+	assert.Nil(applyFlags(&config.TLS, explicit))
+	assert.Equal(":9000", *httpAddress)
+	assert.Equal("/etc/kranen/cert.pem", *certificatePath)
+	assert.Equal("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", *tlsCipherSuites)
+	assert.Equal(8760*time.Hour, *hstsMaxAge)
+
+	// Explicit addresses win over the listeners of the config file
+	assert.Equal(config.Server.Listeners, configListeners(config.Server.Listeners, map[string]bool{"dataDir": true}))
+	assert.Nil(configListeners(config.Server.Listeners, explicit))
+	assert.Nil(configListeners(config.Server.Listeners, map[string]bool{"adminAddress": true}))
+}
+
+func TestMigrateConfig(t *testing.T) {
+	assert := assert.New(t)
+	defer func(config, address, suites string, selfSigned bool) {
+		*configFile, *httpAddress, *tlsCipherSuites, *autoTLS = config, address, suites, selfSigned
+	}(*configFile, *httpAddress, *tlsCipherSuites, *autoTLS)
+	dir, err := ioutil.TempDir("", "kranen-settings-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	legacy := "- name: connctd/test\n  api_key: foobaz\n  tag: latest\n  script: /deploy.sh\n  steps: []\n"
+	*configFile = writeConfig(t, dir, legacy)
+	*httpAddress, *tlsCipherSuites, *autoTLS = ":443", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", true
+	config := migrateConfig([]RepoConfig{{Name: "connctd/test", ApiKey: "foobaz", Tag: "latest", Script: "/deploy.sh"}},
+		map[string]bool{"httpAddress": true, "tlsCipherSuites": true, "tls": true})
+	assert.Equal(ServerConfig{HTTPAddress: ":443"}, config.Server)
+	assert.Equal(TLSConfig{SelfSigned: true, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, config.TLS)
+
+	assert.Equal(0, migrateCommand(nil))
+	backup, err := ioutil.ReadFile(*configFile + ".v1")
+	assert.Nil(err)
+	assert.Equal(legacy, string(backup))
+	content, err := ioutil.ReadFile(*configFile)
+	assert.Nil(err)
+	var migrated map[string]interface{}
+	assert.Nil(yaml.Unmarshal(content, &migrated))
+	assert.Equal(2, migrated["version"])
+	assert.NotContains(string(content), "forward")
+
+	loaded, version, err := loadConfig(*configFile)
+	assert.Nil(err)
+	assert.Equal(2, version)
+	assert.Equal([]RepoConfig{{Name: "connctd/test", ApiKey: "foobaz", Tag: "latest", Script: "/deploy.sh"}}, loaded.Hooks)
+
+	// Migrating again doesn't change the file
+	assert.Equal(0, migrateCommand(nil))
+	again, _ := ioutil.ReadFile(*configFile)
+	assert.Equal(content, again)
+}
+
+func TestConfigIncludes(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-settings-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	confDir := filepath.Join(dir, "conf.d")
+	os.MkdirAll(filepath.Join(dir, "teams"), 0700)
+	os.MkdirAll(confDir, 0700)
+
+	path := writeConfig(t, dir, "version: 2\ninclude: [teams/*.yml]\ndefaults:\n  api_key: foobaz\nhooks:\n  - {name: connctd/main, tag: latest, script: /main.sh}\n")
+	ioutil.WriteFile(filepath.Join(dir, "teams", "a.yml"), []byte("- {name: connctd/a, tag: latest, script: /a.sh}\n"), 0600)
+	ioutil.WriteFile(filepath.Join(confDir, "b.yaml"), []byte("hooks:\n  - {id: b, name: connctd/b, tag: latest, script: /b.sh}\n"), 0600)
+	ioutil.WriteFile(filepath.Join(confDir, "README"), []byte("not a hook file"), 0600)
+
+	config, err := loadConfigFiles(path, confDir)
+	assert.Nil(err)
+	assert.Nil(config.validate())
+	ids := make([]string, len(config.Hooks))
+	for i, hook := range config.Hooks {
+		ids[i] = hook.HookID()
+		assert.Equal("foobaz", hook.ApiKey)
+	}
+	assert.Equal([]string{"connctd/main:latest", "connctd/a:latest", "b"}, ids)
+	assert.Equal([]string{path, filepath.Join(dir, "teams", "a.yml"), filepath.Join(confDir, "b.yaml")}, config.sources)
+
+	// Without a config file only the directory is read
+	config, err = loadConfigFiles("", confDir)
+	assert.Nil(err)
+	assert.Equal(1, len(config.Hooks))
+	_, err = loadConfigFiles("", "")
+	assert.NotNil(err)
+
+	// Errors name the file which contains the hook
+	ioutil.WriteFile(filepath.Join(confDir, "c.yml"), []byte("- {id: c, name: connctd/c, tag: latest, script: /c.sh, steps: [{script: /d.sh}]}\n"), 0600)
+	config, err = loadConfigFiles(path, confDir)
+	assert.Nil(err)
+	err = config.validate()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), filepath.Join(confDir, "c.yml")+": Hook c")
+
+	ioutil.WriteFile(filepath.Join(confDir, "c.yml"), []byte("- {id: b, name: connctd/c, tag: latest, script: /c.sh}\n"), 0600)
+	config, err = loadConfigFiles(path, confDir)
+	assert.Nil(err)
+	err = config.validate()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Hook b is defined twice, in "+filepath.Join(confDir, "b.yaml")+" and "+filepath.Join(confDir, "c.yml"))
+
+	ioutil.WriteFile(filepath.Join(confDir, "c.yml"), []byte("server:\n  http_address: ':80'\nhooks: []\n"), 0600)
+	_, err = loadConfigFiles(path, confDir)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), filepath.Join(confDir, "c.yml"))
+
+	// A config file inside its own config directory or matched by its includes isn't loaded twice,
+	// even if its path is given differently
+	os.Remove(filepath.Join(confDir, "c.yml"))
+	mainConfig := filepath.Join(confDir, "main.yml")
+	ioutil.WriteFile(mainConfig, []byte("version: 2\ninclude: ['*.yml']\ndefaults:\n  api_key: foobaz\nhooks:\n  - {name: connctd/main, tag: latest, script: /main.sh}\n"), 0600)
+	for _, configPath := range []string{mainConfig, confDir + "/./main.yml", filepath.Join(dir, "teams") + "/../conf.d/main.yml"} {
+		config, err = loadConfigFiles(configPath, confDir)
+		assert.Nil(err, configPath)
+		assert.Nil(config.validate(), configPath)
+		assert.Equal(2, len(config.Hooks), configPath)
+	}
+}
+
+func TestSharedRepositoryIDs(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-settings-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// A version 1 config may use the same repository and tag with different keys
+	config, _, err := loadConfig(writeConfig(t, dir, `
+- {api_key: team-a, name: connctd/test, tag: latest, script: /a.sh}
+- {api_key: team-b, name: connctd/test, tag: latest, script: /b.sh}
+- {api_key: team-a, name: connctd/other, tag: latest, script: /other.sh}
+`))
+	assert.Nil(err)
+	assert.Nil(config.validate())
+	assert.Equal("connctd/test:latest@"+hashKey("team-a")[:8], config.Hooks[0].HookID())
+	assert.Equal("connctd/test:latest@"+hashKey("team-b")[:8], config.Hooks[1].HookID())
+	assert.Equal("connctd/other:latest", config.Hooks[2].HookID())
+
+	// The same repository and tag with the same key is a conflict
+	config, _, err = loadConfig(writeConfig(t, dir, `
+- {api_key: team-a, name: connctd/test, tag: latest, script: /a.sh}
+- {api_key: team-a, name: connctd/test, tag: latest, script: /b.sh}
+`))
+	assert.Nil(err)
+	err = config.validate()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "Hook connctd/test:latest is defined twice")
+		assert.Contains(err.Error(), "set id to tell them apart")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-settings-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	config, _, err := loadConfig(writeConfig(t, dir, `
+version: 2
+defaults:
+  api_key: foobaz
+  tag: latest
+  debounce: 30s
+templates:
+  compose:
+    script: /compose.sh
+    retry: {max_attempts: 3}
+  staging:
+    extends: compose
+    tag: staging
+    api_key: staging-key
+hooks:
+  - name: connctd/a
+    extends: staging
+  - name: connctd/b
+    extends: staging
+    tag: preview
+    retry: {max_attempts: 1}
+  - name: connctd/c
+`))
+	assert.Nil(err)
+	assert.Nil(config.validate())
+	retry3, retry1 := &RetryConfig{MaxAttempts: 3}, &RetryConfig{MaxAttempts: 1}
+	assert.Equal(RepoConfig{Name: "connctd/a", ApiKey: "staging-key", Tag: "staging", Script: "/compose.sh", Retry: retry3, Debounce: 30 * time.Second}, config.Hooks[0])
+	assert.Equal(RepoConfig{Name: "connctd/b", ApiKey: "staging-key", Tag: "preview", Script: "/compose.sh", Retry: retry1, Debounce: 30 * time.Second}, config.Hooks[1])
+	assert.Equal(RepoConfig{Name: "connctd/c", ApiKey: "foobaz", Tag: "latest", Debounce: 30 * time.Second}, config.Hooks[2])
+
+	// The timeout of the defaults applies to the steps which don't set their own
+	config, _, err = loadConfig(writeConfig(t, dir, "version: 2\ndefaults:\n  timeout: 1m\nhooks:\n  - name: connctd/a\n    steps:\n      - script: /build.sh\n      - script: /deploy.sh\n        timeout: 5m\n"))
+	assert.Nil(err)
+	assert.Nil(config.validate())
+	assert.Equal([]StepConfig{{Name: "step1", Script: "/build.sh", Timeout: time.Minute}, {Name: "step2", Script: "/deploy.sh", Timeout: 5 * time.Minute}}, config.Hooks[0].Pipeline())
+
+	// script, gitops, forward and steps are taken as a unit, so a script of the defaults or a
+	// template doesn't conflict with steps of the hook and the other way round
+	config, _, err = loadConfig(writeConfig(t, dir, `
+version: 2
+defaults:
+  script: /default.sh
+  timeout: 1m
+templates:
+  pipeline:
+    steps:
+      - script: /build.sh
+      - script: /deploy.sh
+        timeout: 5m
+hooks:
+  - name: connctd/a
+    steps:
+      - script: /a.sh
+  - name: connctd/b
+    extends: pipeline
+  - name: connctd/c
+    extends: pipeline
+    script: /c.sh
+  - name: connctd/d
+`))
+	assert.Nil(err)
+	assert.Nil(config.validate())
+	assert.Equal([]StepConfig{{Name: "step1", Script: "/a.sh", Timeout: time.Minute}}, config.Hooks[0].Pipeline())
+	assert.Equal([]StepConfig{{Name: "step1", Script: "/build.sh", Timeout: time.Minute}, {Name: "step2", Script: "/deploy.sh", Timeout: 5 * time.Minute}}, config.Hooks[1].Pipeline())
+	assert.Equal([]StepConfig{{Name: "script", Script: "/c.sh", Timeout: time.Minute}}, config.Hooks[2].Pipeline())
+	assert.Equal([]StepConfig{{Name: "script", Script: "/default.sh", Timeout: time.Minute}}, config.Hooks[3].Pipeline())
+
+	// Fields set to their zero value aren't taken from templates and defaults
+	config, _, err = loadConfig(writeConfig(t, dir, `
+version: 2
+defaults:
+  debounce: 30s
+  timeout: 1m
+  script_prefix: /opt/deploy/run.sh
+templates:
+  immediate:
+    debounce: 0s
+hooks:
+  - name: connctd/a
+    debounce: 0s
+    script: deploy.sh
+  - name: connctd/b
+    extends: immediate
+    script: deploy.sh
+  - name: connctd/c
+    timeout: 0s
+    script_prefix: ""
+    script: /deploy.sh
+`))
+	assert.Nil(err)
+	assert.Nil(config.validate())
+	assert.Equal(time.Duration(0), config.Hooks[0].Debounce)
+	assert.Equal(time.Duration(0), config.Hooks[1].Debounce)
+	assert.Equal(30*time.Second, config.Hooks[2].Debounce)
+	assert.Equal([]StepConfig{{Name: "script", Script: "/opt/deploy/run.sh deploy.sh", Timeout: time.Minute}}, config.Hooks[0].Pipeline())
+	assert.Equal([]StepConfig{{Name: "script", Script: "/deploy.sh"}}, config.Hooks[2].Pipeline())
+
+	for _, content := range []string{
+		"version: 2\nhooks:\n  - {name: connctd/a, extends: unknown}",
+		"version: 2\ntemplates:\n  a: {extends: b}\n  b: {extends: a}\nhooks:\n  - {name: connctd/a, extends: a}",
+		"version: 2\ntemplates:\n  a: {id: shared}\nhooks: []",
+		"version: 2\ndefaults: {extends: a}\ntemplates:\n  a: {tag: latest}\nhooks: []",
+	} {
+		config, _, err = loadConfig(writeConfig(t, dir, content))
+		assert.Nil(err)
+		assert.NotNil(config.validate(), content)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+	defer func(address string) { *httpAddress = address }(*httpAddress)
+
+	configs = []RepoConfig{{Name: "connctd/test", ApiKey: "foobaz", Tag: "latest", Script: "/deploy.sh"}}
+	*httpAddress = ":9000"
+	content, err := yaml.Marshal(effectiveConfig())
+	assert.Nil(err)
+	var dumped Config
+	assert.Nil(yaml.Unmarshal(content, &dumped))
+	assert.Equal(configVersion, dumped.Version)
+	assert.Equal(":9000", dumped.Server.HTTPAddress)
+	assert.Equal("1.2", dumped.TLS.MinVersion)
+	assert.Nil(dumped.TLS.CipherSuites)
+	assert.Equal(configs, dumped.Hooks)
+}
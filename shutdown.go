@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const serverShutdownTimeout = 5 * time.Second
+
+var (
+	// draining is set once kranen shuts down, new events are rejected from then on
+	draining atomic.Bool
+	// pendingJobs counts queued and running jobs
+	pendingJobs = new(sync.WaitGroup)
+	// runContext is cancelled when the drain timeout expires to stop running scripts
+	runContext, cancelRuns = context.WithCancel(context.Background())
+)
+
+// waitForShutdown blocks until SIGTERM or SIGINT is received, drains the execution queue
+// and shuts down the servers
+func waitForShutdown(servers ...*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	logger.Info("Shutting down", "signal", sig.String(), "drain_timeout", drainTimeout.String(), "drain_queue", *drainQueue)
+
+	if drain(*drainTimeout) {
+		logger.Info("All jobs finished")
+	}
+	if !waitForNotifications(serverShutdownTimeout) {
+		logger.Warn("Not all notifications were sent")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("Can't shut down server", "address", server.Addr, "error", err)
+		}
+	}
+	if exporter != nil {
+		exporter.Flush(serverShutdownTimeout)
+	}
+	audit.Close()
+}
+
+// drain stops accepting new events and waits for pending jobs. Queued jobs are only executed
+// if -drainQueue is set, otherwise they are recorded as interrupted. If the jobs don't finish
+// within the timeout running scripts are stopped. It returns true if all jobs finished in time.
+func drain(timeout time.Duration) bool {
+	draining.Store(true)
+	executorAccepting.Store(false)
+
+	done := make(chan struct{})
+	pending := pendingJobs
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	logger.Warn("Drain timeout expired, stopping running scripts")
+	cancelRuns()
+	select {
+	case <-done:
+	case <-time.After(scriptStopGrace + time.Second):
+		logger.Error("Jobs did not stop in time")
+	}
+	return false
+}
+
+// skipJob records a queued job as interrupted instead of executing it
+func skipJob(job Job) {
+	history.update(job.Run, func(run *Run) {
+		run.Status = StatusInterrupted
+		run.Finished = time.Now()
+	})
+	job.logger().Warn("Queued run was not executed because kranen is shutting down")
+}
+
+func rejectWhileDraining(w http.ResponseWriter) bool {
+	if !draining.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", "30")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestExecutor runs an executor and returns a function which stops it and resets the shutdown state.
+// The globals are only restored after the executor has finished its last job.
+func startTestExecutor(t *testing.T) func() {
+	previousExec := execCommand
+	previousChan := executionChan
+	previousGrace := scriptStopGrace
+	previousPending := pendingJobs
+	pendingJobs = new(sync.WaitGroup)
+	execCommand = exec.Command
+	scriptStopGrace = 100 * time.Millisecond
+	executionChan = make(chan Job)
+	done := make(chan struct{})
+	go func() {
+		executeCommands()
+		close(done)
+	}()
+	return func() {
+		pendingJobs.Wait()
+		close(executionChan)
+		<-done
+		execCommand = previousExec
+		executionChan = previousChan
+		scriptStopGrace = previousGrace
+		pendingJobs = previousPending
+		draining.Store(false)
+		runContext, cancelRuns = context.WithCancel(context.Background())
+	}
+}
+
+func waitForStatus(t *testing.T, id string, status RunStatus) Run {
+	for i := 0; i < 100; i++ {
+		if run, _ := history.Get(id); run.Status == status {
+			return run
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	run, _ := history.Get(id)
+	t.Fatalf("Run %s has status %s instead of %s", id, run.Status, status)
+	return run
+}
+
+func TestDrainStopsRunningScripts(t *testing.T) {
+	assert := assert.New(t)
+	defer startTestExecutor(t)()
+
+	dir, err := ioutil.TempDir("", "kranen-shutdown-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	slow := writeScript(t, dir, "slow.sh", "sleep 10\n")
+	running := testJob(t, RepoConfig{Steps: []StepConfig{{Name: "slow", Script: slow}, {Name: "next", Script: slow}}})
+	queued := testJob(t, RepoConfig{Script: slow})
+
+	executeScript(running)
+	waitForStatus(t, running.Run.ID, StatusRunning)
+	executeScript(queued)
+
+	start := time.Now()
+	assert.False(drain(50 * time.Millisecond))
+	assert.True(time.Since(start) < 2*time.Second)
+
+	run := waitForStatus(t, running.Run.ID, StatusInterrupted)
+	assert.Equal(StatusInterrupted, run.Steps[0].Status)
+	assert.Equal(StatusSkipped, run.Steps[1].Status)
+	waitForStatus(t, queued.Run.ID, StatusInterrupted)
+}
+
+func TestDrainWaitsForRunningJobs(t *testing.T) {
+	assert := assert.New(t)
+	defer startTestExecutor(t)()
+
+	dir, err := ioutil.TempDir("", "kranen-shutdown-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	short := writeScript(t, dir, "short.sh", "sleep 0.2\n")
+	running := testJob(t, RepoConfig{Script: short})
+	queued := testJob(t, RepoConfig{Script: short})
+
+	executeScript(running)
+	waitForStatus(t, running.Run.ID, StatusRunning)
+	executeScript(queued)
+
+	assert.True(drain(5 * time.Second))
+	waitForStatus(t, running.Run.ID, StatusSucceeded)
+	waitForStatus(t, queued.Run.ID, StatusInterrupted)
+
+	prepare()
+	testHook(successPayload, "foobaz", assert, http.StatusServiceUnavailable)
+}
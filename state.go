@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFileName = "state.json"
+
+// Deployment describes a successful run of a hook
+type Deployment struct {
+	Repo    string          `json:"repo"`
+	Tag     string          `json:"tag"`
+	Digest  string          `json:"digest,omitempty"`
+	RunID   string          `json:"run_id"`
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// stateStore remembers the last successful deployment per hook. If a path is set the
+// state is persisted so it survives restarts and can be used by the rollback command.
+type stateStore struct {
+	sync.Mutex
+	path        string
+	deployments map[string]Deployment
+}
+
+var state = newStateStore("")
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{
+		path:        path,
+		deployments: make(map[string]Deployment),
+	}
+}
+
+func loadStateStore(dataDir string) (*stateStore, error) {
+	store := newStateStore(filepath.Join(dataDir, stateFileName))
+	content, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &store.deployments); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// LastSuccessful returns the last successful deployment of the hook
+func (s *stateStore) LastSuccessful(hook string) (Deployment, bool) {
+	s.Lock()
+	defer s.Unlock()
+	deployment, found := s.deployments[hook]
+	return deployment, found
+}
+
+// RecordSuccess stores the deployment as the last successful one of the hook
+func (s *stateStore) RecordSuccess(hook string, deployment Deployment) error {
+	s.Lock()
+	defer s.Unlock()
+	s.deployments[hook] = deployment
+	if s.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(s.deployments, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, content, 0600)
+}
+
+// checkWritable verifies that the state can be persisted
+func (s *stateStore) checkWritable() error {
+	if s.path == "" {
+		return nil
+	}
+	file, err := ioutil.TempFile(filepath.Dir(s.path), ".kranen-check")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// writeFileAtomic writes to a temporary file first and renames it, so readers
+// never see partially written files
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// streamKeepAlive is the interval of comments sent to keep idle streams open
+var streamKeepAlive = 15 * time.Second
+
+// StreamStatus is the data of the final status event of a run stream
+type StreamStatus struct {
+	Status   RunStatus `json:"status"`
+	Finished time.Time `json:"finished"`
+}
+
+// streamRun sends the log of the run as Server-Sent Events. Every line is a "log" event whose ID is
+// the line number, so clients resume with Last-Event-ID. The lines logged so far are replayed
+// first and the stream ends with a "status" event once the run finished.
+func streamRun(w http.ResponseWriter, r *http.Request, ps httprouter.Params, user string) {
+	id := ps.ByName("id")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+	next := 0
+	if lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = lastID + 1
+	}
+	if _, found := history.Get(id); !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Run %s does not exist", id))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		run, lines, end, changed, found := history.Watch(id, next)
+		if !found {
+			// The run was removed from the history
+			return
+		}
+		for i, line := range lines {
+			data, _ := json.Marshal(line)
+			fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", end-len(lines)+i, data)
+		}
+		next = end
+		if run.Status.Final() {
+			data, _ := json.Marshal(StreamStatus{Status: run.Status, Finished: run.Finished})
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-time.After(streamKeepAlive):
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
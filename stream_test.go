@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads Server-Sent Events until the stream is closed
+func readEvents(t *testing.T, resp *http.Response, events chan<- map[string]string) {
+	defer close(events)
+	scanner := bufio.NewScanner(resp.Body)
+	event := make(map[string]string)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(event) > 0 {
+				events <- event
+			}
+			event = make(map[string]string)
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) == 2 && parts[0] != "" {
+			event[parts[0]] = parts[1]
+		}
+	}
+}
+
+func TestStreamRun(t *testing.T) {
+	assert := assert.New(t)
+	defer func(previous chan Job) { executionChan = previous }(executionChan)
+	server, _ := adminTestServer(t)
+	defer server.Close()
+
+	run := &Run{ID: newRunID(), Hook: "test", Status: StatusRunning, Started: time.Now()}
+	history.add(run)
+	history.appendLog(run, LogLine{Step: "deploy", Stream: "stdout", Line: "first"})
+
+	stream := func(lastID string) chan map[string]string {
+		req, _ := http.NewRequest("GET", server.URL+"/runs/"+run.ID+"/stream", nil)
+		req.SetBasicAuth("alice", "secret")
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+		events := make(chan map[string]string, 10)
+		go readEvents(t, resp, events)
+		return events
+	}
+
+	events := stream("")
+	event := <-events
+	assert.Equal("log", event["event"])
+	assert.Equal("0", event["id"])
+	assert.Contains(event["data"], `"line":"first"`)
+
+	history.appendLog(run, LogLine{Step: "deploy", Stream: "stderr", Line: "second"})
+	event = <-events
+	assert.Equal("1", event["id"])
+	assert.Contains(event["data"], `"stream":"stderr"`)
+
+	history.update(run, func(run *Run) {
+		run.Status = StatusSucceeded
+		run.Finished = time.Now()
+	})
+	event = <-events
+	assert.Equal("status", event["event"])
+	assert.Contains(event["data"], `"status":"succeeded"`)
+	_, open := <-events
+	assert.False(open)
+
+	// Finished runs are replayed from the given event ID
+	events = stream("0")
+	event = <-events
+	assert.Equal("1", event["id"])
+	event = <-events
+	assert.Equal("status", event["event"])
+
+	req, _ := http.NewRequest("GET", server.URL+"/runs/unknown/stream", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func openSyslog() (io.Writer, error) {
+	return nil, fmt.Errorf("Syslog is not supported on Windows")
+}
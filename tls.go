@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/kabukky/httpscerts"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig creates the TLS config of the webhook listener. Cipher suites are given by their
+// standard names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, and only apply to TLS 1.2 and older.
+func newTLSConfig(minVersion, cipherSuites string) (*tls.Config, error) {
+	version, found := tlsVersions[minVersion]
+	if !found {
+		return nil, fmt.Errorf("Unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+	if cipherSuites == "" {
+		return config, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(cipherSuites, ",") {
+		name = strings.TrimSpace(name)
+		id, found := suites[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
+
+// withHSTS adds the Strict-Transport-Security header to responses of TLS requests
+func withHSTS(next http.Handler, maxAge time.Duration) http.Handler {
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10) + "; includeSubDomains"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certReloader serves a certificate from files, which is reloaded when the files change or on SIGHUP.
+// Established connections keep using the certificate of their handshake.
+type certReloader struct {
+	sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// modified returns the latest modification time of the certificate and key files
+func (c *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	logger.Info("Loaded certificate", "cert", c.certPath, "modified", modTime)
+	return nil
+}
+
+// reloadIfChanged reloads the certificate if one of the files was modified since the last load
+func (c *certReloader) reloadIfChanged() error {
+	modTime, err := c.modified()
+	if err != nil {
+		return err
+	}
+	c.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.RUnlock()
+	if !changed {
+		return nil
+	}
+	return c.reload()
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// watch checks the files for changes every interval and reloads the certificate on SIGHUP. The
+// previous certificate stays in use if the new one can't be loaded.
+func (c *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		var err error
+		select {
+		case <-hup:
+			err = c.reload()
+		case <-tick:
+			err = c.reloadIfChanged()
+		}
+		if err != nil {
+			logger.Error("Can't reload certificate, keeping the current one", "cert", c.certPath, "error", err)
+		}
+	}
+}
+
+// selfSignedCertificate returns the paths of a self signed certificate for the host in dir. An existing
+// certificate is reused while it is valid for the host for at least another day. The host may be a comma
+// separated list of names and IP addresses.
+func selfSignedCertificate(dir, host string) (string, string, error) {
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if usableCertificate(certPath, keyPath, host) {
+		return certPath, keyPath, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	if err := httpscerts.Generate(certPath, keyPath, host); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+func usableCertificate(certPath, keyPath, host string) bool {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	for _, name := range strings.Split(host, ",") {
+		if cert.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return time.Now().Add(24 * time.Hour).Before(cert.NotAfter)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+	config, err := newTLSConfig("1.3", "")
+	assert.Nil(err)
+	assert.Equal(uint16(tls.VersionTLS13), config.MinVersion)
+	assert.Nil(config.CipherSuites)
+
+	config, err = newTLSConfig("1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	assert.Nil(err)
+	assert.Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, config.CipherSuites)
+
+	_, err = newTLSConfig("1.4", "")
+	assert.NotNil(err)
+	_, err = newTLSConfig("1.2", "TLS_RSA_WITH_RC4_128_SHA")
+	assert.NotNil(err)
+}
+
+func TestHSTS(t *testing.T) {
+	assert := assert.New(t)
+	handler := withHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 365*24*time.Hour)
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	assert.Nil(err)
+	assert.Equal("max-age=31536000; includeSubDomains", resp.Header.Get("Strict-Transport-Security"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal("", w.Header().Get("Strict-Transport-Security"))
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-tls-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	tlsDir := filepath.Join(dir, "tls")
+
+	certPath, keyPath, err := selfSignedCertificate(tlsDir, "kranen.example.com")
+	assert.Nil(err)
+	assert.Equal(filepath.Join(tlsDir, "cert.pem"), certPath)
+	assert.Equal(filepath.Join(tlsDir, "key.pem"), keyPath)
+	first, _ := ioutil.ReadFile(certPath)
+
+	// An existing certificate for the host is reused
+	_, _, err = selfSignedCertificate(tlsDir, "kranen.example.com")
+	assert.Nil(err)
+	second, _ := ioutil.ReadFile(certPath)
+	assert.Equal(first, second)
+
+	_, _, err = selfSignedCertificate(tlsDir, "other.example.com,127.0.0.1")
+	assert.Nil(err)
+	third, _ := ioutil.ReadFile(certPath)
+	assert.False(bytes.Equal(first, third))
+	assert.True(usableCertificate(certPath, keyPath, "127.0.0.1"))
+}
+
+func TestCertReloader(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kranen-tls-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath, err := selfSignedCertificate(dir, "kranen.example.com")
+	assert.Nil(err)
+	reloader, err := newCertReloader(certPath, keyPath)
+	assert.Nil(err)
+	first, _ := reloader.GetCertificate(nil)
+
+	assert.Nil(reloader.reloadIfChanged())
+	unchanged, _ := reloader.GetCertificate(nil)
+	assert.True(first == unchanged)
+
+	_, _, err = selfSignedCertificate(dir, "other.example.com")
+	assert.Nil(err)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	assert.Nil(reloader.reloadIfChanged())
+	renewed, _ := reloader.GetCertificate(nil)
+	assert.False(bytes.Equal(first.Certificate[0], renewed.Certificate[0]))
+
+	// A broken certificate doesn't replace the loaded one
+	ioutil.WriteFile(certPath, []byte("broken"), 0600)
+	os.Chtimes(certPath, later.Add(time.Minute), later.Add(time.Minute))
+	assert.NotNil(reloader.reloadIfChanged())
+	current, _ := reloader.GetCertificate(nil)
+	assert.True(renewed == current)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	traceparentEnvVar = "TRACEPARENT"
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	// traceFlagSampled is set on traces started by kranen, their spans are exported
+	traceFlagSampled = 0x01
+
+	exportBatchSize = 256
+	exportQueueSize = 2048
+)
+
+var exportInterval = 5 * time.Second
+
+// spanContext identifies a span within a trace as in the W3C trace context
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Flags are the trace flags of the caller, they are passed on unchanged
+	Flags byte
+}
+
+func (s spanContext) IsValid() bool {
+	return s.TraceID != [16]byte{} && s.SpanID != [8]byte{}
+}
+
+// Traceparent formats the span context as W3C traceparent header value
+func (s spanContext) Traceparent() string {
+	if !s.IsValid() {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-" + hex.EncodeToString([]byte{s.Flags})
+}
+
+// parseTraceparent parses a W3C traceparent header value. Version 00 has exactly four fields,
+// later versions may append fields which are ignored.
+func parseTraceparent(value string) (spanContext, bool) {
+	var result spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return result, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return result, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return result, false
+	}
+	result.Flags = flags[0]
+	if _, err := hex.Decode(result.TraceID[:], []byte(parts[1])); err != nil {
+		return result, false
+	}
+	if _, err := hex.Decode(result.SpanID[:], []byte(parts[2])); err != nil {
+		return result, false
+	}
+	return result, result.IsValid()
+}
+
+// span is a timed operation which is exported via OTLP once it ended
+type span struct {
+	context    spanContext
+	parent     [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes []string
+	err        error
+}
+
+func withSpanContext(ctx context.Context, sc spanContext) context.Context {
+	return context.WithValue(ctx, spanKey, sc)
+}
+
+// spanContextFrom returns the context of the current span, which is invalid if there is none
+func spanContextFrom(ctx context.Context) spanContext {
+	sc, _ := ctx.Value(spanKey).(spanContext)
+	return sc
+}
+
+// startSpan starts a child span of the current span or a new trace. Attributes are given as
+// key value pairs.
+func startSpan(ctx context.Context, name string, attributes ...string) (context.Context, *span) {
+	return startSpanAt(ctx, name, time.Now(), attributes...)
+}
+
+func startSpanAt(ctx context.Context, name string, start time.Time, attributes ...string) (context.Context, *span) {
+	parent := spanContextFrom(ctx)
+	s := &span{name: name, kind: spanKindInternal, start: start, attributes: attributes, parent: parent.SpanID}
+	if parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.context.Flags = parent.Flags
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Flags = traceFlagSampled
+	}
+	rand.Read(s.context.SpanID[:])
+	return withSpanContext(ctx, s.context), s
+}
+
+func (s *span) SetAttributes(attributes ...string) {
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// End finishes the span, a non-nil error marks it as failed
+func (s *span) End(err error) {
+	s.end = time.Now()
+	s.err = err
+	if exporter != nil {
+		exporter.add(s)
+	}
+}
+
+// exporter sends finished spans to an OTLP/HTTP endpoint, spans are dropped if it is nil
+var exporter *spanExporter
+
+type spanExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *span
+	flush   chan chan struct{}
+}
+
+// newSpanExporter starts exporting spans to the OTLP/HTTP endpoint, e.g. http://localhost:4318
+func newSpanExporter(endpoint, service string) *spanExporter {
+	e := &spanExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan *span, exportQueueSize),
+		flush:   make(chan chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *spanExporter) add(s *span) {
+	select {
+	case e.spans <- s:
+	default:
+		logger.Debug("Dropping span, export queue is full", "span", s.name)
+	}
+}
+
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, exportBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			logger.Warn("Can't export spans", "url", e.url, "error", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-e.flush:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			export()
+			close(done)
+		}
+	}
+}
+
+// Flush exports all finished spans and waits until they were sent or the timeout expired
+func (e *spanExporter) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(keyValues []string) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(keyValues)/2)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		attributes = append(attributes, otlpAttribute{Key: keyValues[i], Value: otlpValue{StringValue: keyValues[i+1]}})
+	}
+	return attributes
+}
+
+// export sends the spans encoded as OTLP JSON
+func (e *spanExporter) export(spans []*span) error {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: spanStatusOK},
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+		}
+		encoded = append(encoded, o)
+	}
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]string{"service.name", e.service, "service.version", version}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "kranen"},
+				"spans": encoded,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// collectorStandIn records the spans of OTLP/HTTP JSON export requests
+type collectorStandIn struct {
+	sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *collectorStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&request) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, resource := range request.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			c.spans = append(c.spans, scope.Spans...)
+		}
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	assert := assert.New(t)
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(ok)
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// The flags of the caller are kept, also in child spans
+	sc, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(ok)
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", sc.Traceparent())
+	_, child := startSpan(withSpanContext(context.Background(), sc), "child")
+	assert.True(strings.HasSuffix(child.context.Traceparent(), "-00"))
+	_, root := startSpan(context.Background(), "root")
+	assert.True(strings.HasSuffix(root.context.Traceparent(), "-01"))
+
+	// Later versions may have more fields
+	_, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(ok)
+
+	for _, invalid := range []string{
+		"",
+		"00-xyz-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		_, ok = parseTraceparent(invalid)
+		assert.False(ok, invalid)
+	}
+}
+
+func TestWebhookTrace(t *testing.T) {
+	assert := assert.New(t)
+	defer startTestExecutor(t)()
+	defer func(previous []RepoConfig) { configs = previous }(configs)
+	defer func(previous *spanExporter) { exporter = previous }(exporter)
+
+	collector := &collectorStandIn{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+	exporter = newSpanExporter(collectorServer.URL, "kranen-test")
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer callbackServer.Close()
+
+	dir, err := ioutil.TempDir("", "kranen-tracing-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	traceparent := filepath.Join(dir, "traceparent")
+	deploy := writeScript(t, dir, "deploy.sh", "echo -n $TRACEPARENT > "+traceparent+"\n")
+	configs = []RepoConfig{{ApiKey: "foobaz", Name: "connctd/test", Tag: "latest", Script: deploy}}
+
+	router := httprouter.New()
+	router.POST("/docker/:apikey", hook)
+	payload := strings.Replace(successPayload, "https://registry.hub.docker.com/u/connctd/gate/hook/25040jj1i4e2a4jc1ehbabb41hj45h0ef/", callbackServer.URL, 1)
+	req := httptest.NewRequest("POST", "/docker/foobaz", strings.NewReader(payload))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+
+	pendingJobs.Wait()
+	exporter.Flush(serverShutdownTimeout)
+	collector.Lock()
+	defer collector.Unlock()
+	spans := make(map[string]otlpSpan)
+	for _, span := range collector.spans {
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+		spans[span.Name] = span
+	}
+	for _, name := range []string{"webhook", "decode", "match", "queue wait", "run", "step script", "render", "exec", "callback"} {
+		_, found := spans[name]
+		assert.True(found, name)
+	}
+	assert.Equal("00f067aa0ba902b7", spans["webhook"].ParentSpanID)
+	assert.Equal(spans["webhook"].SpanID, spans["run"].ParentSpanID)
+	assert.Equal(spans["run"].SpanID, spans["step script"].ParentSpanID)
+	assert.Equal(spans["step script"].SpanID, spans["exec"].ParentSpanID)
+	assert.Equal(spans["run"].SpanID, spans["callback"].ParentSpanID)
+
+	content, err := ioutil.ReadFile(traceparent)
+	assert.Nil(err)
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-"+spans["exec"].SpanID+"-01", string(content))
+}